@@ -0,0 +1,158 @@
+package blockpage
+
+// Pages served in place of blocked content.  The built-in pages can be
+// replaced with your own html/template files (see BlockedData and BadUrlData
+// for what they get to work with).  Requests that ask for JSON in their Accept
+// header get the same information as JSON instead.
+//
+// Urls come from whoever made the request, so everything is rendered with
+// html/template to keep a crafted url from injecting markup or script.
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/jcuga/proxyblock/proxy/rules"
+	"github.com/jcuga/proxyblock/proxy/vars"
+)
+
+const (
+	ContentTypeHtml = "text/html; charset=utf-8"
+	ContentTypeJson = "application/json"
+)
+
+var (
+	//go:embed templates
+	templates embed.FS
+)
+
+// What the block page template is rendered with
+type BlockedData struct {
+	Url     string `json:"url"`
+	Referer string `json:"referer"`
+	// The pattern of the rule that blocked the url and where it's from
+	// (file:line), empty for urls blocked from the page controls
+	Rule         string `json:"rule"`
+	RuleLocation string `json:"rule_location"`
+	Reason       string `json:"reason"`
+	// The url again with the proxy exception string to get past the block
+	ContinueUrl string `json:"continue_url"`
+	// Control server link that whitelists the url and then redirects to it
+	WhitelistUrl string `json:"whitelist_url"`
+}
+
+// What the "can't rewrite url" page template is rendered with
+type BadUrlData struct {
+	Url     string `json:"url"`
+	Referer string `json:"referer"`
+	Error   string `json:"error"`
+}
+
+type Pages struct {
+	blocked *template.Template
+	badUrl  *template.Template
+}
+
+// Load the block page templates, an empty filename means the built-in page.
+func New(blockedFile, badUrlFile string) (*Pages, error) {
+	blocked, err := load(blockedFile, "templates/blocked.html")
+	if err != nil {
+		return nil, err
+	}
+	badUrl, err := load(badUrlFile, "templates/bad-url.html")
+	if err != nil {
+		return nil, err
+	}
+	return &Pages{blocked: blocked, badUrl: badUrl}, nil
+}
+
+func load(filename, builtin string) (*template.Template, error) {
+	if len(filename) == 0 {
+		return template.ParseFS(templates, builtin)
+	}
+	t, err := template.New(filepath.Base(filename)).ParseFiles(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error loading block page template: %v", err)
+	}
+	return t, nil
+}
+
+// The page shown in place of a blocked request, returns the content type
+// and body.
+func (p *Pages) Blocked(req *http.Request, decision rules.Decision) (string, string) {
+	pageUrl := req.URL.String()
+	data := BlockedData{
+		Url:         pageUrl,
+		Referer:     req.Header.Get("Referer"),
+		Reason:      decision.Reason,
+		ContinueUrl: pageUrl + vars.ProxyExceptionString,
+		WhitelistUrl: "http://127.0.0.1:" + vars.ProxyControlPort + "/add-wl?url=" + url.QueryEscape(pageUrl) +
+			"&continue_to_page=yes",
+	}
+	if decision.Rule != nil {
+		data.Rule = decision.Rule.Pattern
+		data.RuleLocation = decision.Rule.Location()
+	}
+	if WantsJson(req) {
+		return renderJson(struct {
+			Blocked bool `json:"blocked"`
+			BlockedData
+		}{true, data})
+	}
+	return render(p.blocked, data)
+}
+
+// The page shown when a manually allowed url can't be rewritten, returns the
+// content type and body.
+func (p *Pages) BadUrl(req *http.Request, pageUrl string, err error) (string, string) {
+	data := BadUrlData{Url: pageUrl, Referer: req.Header.Get("Referer"), Error: err.Error()}
+	if WantsJson(req) {
+		return renderJson(data)
+	}
+	return render(p.badUrl, data)
+}
+
+// Whether the request's Accept header asks for JSON rather than a web page
+func WantsJson(req *http.Request) bool {
+	wantsJson := false
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		switch {
+		case mediaType == "text/html":
+			return false
+		case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+			wantsJson = true
+		}
+	}
+	return wantsJson
+}
+
+func render(t *template.Template, data interface{}) (string, string) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		log.Printf("ERROR: failed to render %s.  error: %q", t.Name(), err)
+		return "text/plain", "Blocked by proxyblock."
+	}
+	return ContentTypeHtml, buf.String()
+}
+
+func renderJson(data interface{}) (string, string) {
+	out, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("ERROR: failed to render json block page.  error: %q", err)
+		return "text/plain", "Blocked by proxyblock."
+	}
+	return ContentTypeJson, string(out)
+}
@@ -0,0 +1,101 @@
+package blockpage
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+
+	"github.com/jcuga/proxyblock/proxy/rules"
+)
+
+// What a crafted url or Referer could try to sneak into a page
+var maliciousStrings = []string{
+	`"><script>alert(1)</script>`,
+	`'><img src=x onerror=alert(1)>`,
+	`</script><script>alert(1)</script>`,
+	`javascript:alert(1)`,
+}
+
+var urlAttrs = map[string]bool{"href": true, "src": true, "action": true, "formaction": true}
+
+// Fail if page has script elements, event handler attributes or javascript:
+// links that the template didn't put there itself.  Returns the page's text.
+func checkPage(t *testing.T, page string) string {
+	t.Helper()
+	var text strings.Builder
+	z := html.NewTokenizer(strings.NewReader(page))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return text.String()
+		case html.TextToken:
+			text.Write(z.Text())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if tok.Data == "script" || tok.Data == "img" {
+				t.Errorf("injected <%s> in page:\n%s", tok.Data, page)
+			}
+			for _, attr := range tok.Attr {
+				if strings.HasPrefix(attr.Key, "on") {
+					t.Errorf("injected %s attribute in page:\n%s", attr.Key, page)
+				}
+				if urlAttrs[attr.Key] && strings.HasPrefix(strings.ToLower(strings.TrimSpace(attr.Val)), "javascript:") {
+					t.Errorf("javascript: url in %s attribute:\n%s", attr.Key, page)
+				}
+			}
+		}
+	}
+}
+
+func TestBlockedEscapesUrls(t *testing.T) {
+	pages, err := New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range maliciousStrings {
+		t.Run(bad, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/ads.js?q="+strings.ReplaceAll(bad, " ", "+"), nil)
+			req.Header.Set("Referer", bad)
+			decision := rules.Decision{
+				Action: rules.Blocked,
+				Rule:   &rules.Rule{Pattern: bad, File: bad, Line: 1},
+				Reason: bad,
+			}
+			contentType, page := pages.Blocked(req, decision)
+			if contentType != ContentTypeHtml {
+				t.Errorf("content type = %q, want %q", contentType, ContentTypeHtml)
+			}
+			if text := checkPage(t, page); !strings.Contains(text, "Requested by "+bad) {
+				t.Errorf("Referer %q not shown as text:\n%s", bad, page)
+			}
+
+			// no rule, the reason is shown instead
+			decision.Rule = nil
+			if _, page = pages.Blocked(req, decision); !strings.Contains(checkPage(t, page), bad) {
+				t.Errorf("reason %q not shown as text:\n%s", bad, page)
+			}
+		})
+	}
+}
+
+func TestBadUrlEscapesUrls(t *testing.T) {
+	pages, err := New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range maliciousStrings {
+		t.Run(bad, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://example.com/", nil)
+			contentType, page := pages.BadUrl(req, bad, errors.New(bad))
+			if contentType != ContentTypeHtml {
+				t.Errorf("content type = %q, want %q", contentType, ContentTypeHtml)
+			}
+			if text := checkPage(t, page); strings.Count(text, bad) != 2 {
+				t.Errorf("url and error %q not shown as text:\n%s", bad, page)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package blockpage
+
+// A block page only makes sense for something the browser is going to show.
+// Images, scripts and stylesheets get an empty stand-in of the right type
+// instead, so the page doesn't fill up with broken image icons and console
+// errors (or retry), and beacons just get a 204.
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/jcuga/proxyblock/proxy/rules"
+	"github.com/jcuga/proxyblock/proxy/surrogates"
+)
+
+// 1x1 transparent gif
+const transparentGif = "GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00" +
+	"!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;"
+
+var extensionKinds = map[string]string{
+	".gif":  rules.ResponseImage,
+	".png":  rules.ResponseImage,
+	".jpg":  rules.ResponseImage,
+	".jpeg": rules.ResponseImage,
+	".webp": rules.ResponseImage,
+	".avif": rules.ResponseImage,
+	".svg":  rules.ResponseImage,
+	".ico":  rules.ResponseImage,
+	".bmp":  rules.ResponseImage,
+	".js":   rules.ResponseScript,
+	".mjs":  rules.ResponseScript,
+	".css":  rules.ResponseStyle,
+}
+
+// What to send back for a blocked request: the status code, content type and
+// body.  The rule that blocked it can name a surrogate to serve instead (see
+// rules.Rule.Redirect) or say what kind of response to use (see
+// rules.Rule.Response), otherwise it's picked by ResponseKind.
+func (p *Pages) Response(req *http.Request, decision rules.Decision) (int, string, string) {
+	kind := ""
+	if decision.Rule != nil {
+		if contentType, body, ok := surrogates.Get(decision.Rule.Redirect); ok {
+			return http.StatusOK, contentType, string(body)
+		}
+		kind = decision.Rule.Response
+	}
+	if len(kind) == 0 {
+		kind = ResponseKind(req)
+	}
+	switch kind {
+	case rules.ResponseImage:
+		return http.StatusOK, "image/gif", transparentGif
+	case rules.ResponseScript:
+		return http.StatusOK, "text/javascript", ""
+	case rules.ResponseStyle:
+		return http.StatusOK, "text/css", ""
+	case rules.ResponseNoContent:
+		return http.StatusNoContent, "text/plain", ""
+	}
+	contentType, body := p.Blocked(req, decision)
+	return http.StatusForbidden, contentType, body
+}
+
+// Guess what kind of response a request wants, going by Sec-Fetch-Dest when
+// the browser sends it, otherwise the Accept header and the url's extension.
+// Anything unsure gets the block page.
+func ResponseKind(req *http.Request) string {
+	if isBeacon(req) {
+		return rules.ResponseNoContent
+	}
+	switch req.Header.Get("Sec-Fetch-Dest") {
+	case "":
+	case "image":
+		return rules.ResponseImage
+	case "script", "worker", "sharedworker", "serviceworker", "audioworklet", "paintworklet":
+		return rules.ResponseScript
+	case "style":
+		return rules.ResponseStyle
+	case "report":
+		return rules.ResponseNoContent
+	default:
+		return rules.ResponsePage
+	}
+	accept := strings.ToLower(req.Header.Get("Accept"))
+	switch {
+	case strings.Contains(accept, "text/html"):
+		return rules.ResponsePage
+	case strings.HasPrefix(accept, "image/"):
+		return rules.ResponseImage
+	case strings.HasPrefix(accept, "text/css"):
+		return rules.ResponseStyle
+	}
+	if kind, ok := extensionKinds[strings.ToLower(path.Ext(req.URL.Path))]; ok {
+		return kind
+	}
+	return rules.ResponsePage
+}
+
+// Whether req is a navigator.sendBeacon() or <a ping> request
+func isBeacon(req *http.Request) bool {
+	if len(req.Header.Get("Ping-To")) > 0 || len(req.Header.Get("Ping-From")) > 0 ||
+		strings.HasPrefix(req.Header.Get("Content-Type"), "text/ping") {
+		return true
+	}
+	return req.Method == http.MethodPost && req.Header.Get("Sec-Fetch-Dest") == "empty" &&
+		req.Header.Get("Sec-Fetch-Mode") == "no-cors"
+}
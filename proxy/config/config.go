@@ -0,0 +1,310 @@
+package config
+
+// All proxy settings in one place.  Settings are read from a JSON file (see
+// proxyblock.example.json) and any command line flags override the file.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jcuga/proxyblock/proxy/rules"
+)
+
+// How the DNS sinkhole answers queries for blocked hosts
+const (
+	DnsBlockNxdomain = "nxdomain"
+	// 0.0.0.0 / ::
+	DnsBlockZero = "zero"
+)
+
+type Config struct {
+	// Address the proxy listens on
+	ListenAddr string `json:"listen_addr"`
+	// Port the control server (page controls, settings, events) listens on,
+	// always on 127.0.0.1
+	ControlPort string `json:"control_port"`
+	// Appended to a url to let it thru the proxy just once
+	ExceptionString string `json:"exception_string"`
+
+	Rules     RulesConfig     `json:"rules"`
+	Injection InjectionConfig `json:"injection"`
+	BlockPage BlockPageConfig `json:"block_page"`
+	Logging   LoggingConfig   `json:"logging"`
+	Storage   StorageConfig   `json:"storage"`
+	Mitm      MitmConfig      `json:"mitm"`
+	Upstream  UpstreamConfig  `json:"upstream"`
+	Tracking  TrackingConfig  `json:"tracking_params"`
+	Headers   HeadersConfig   `json:"headers"`
+	Socks     SocksConfig     `json:"socks"`
+	Pac       PacConfig       `json:"pac"`
+	Dns       DnsConfig       `json:"dns"`
+	Longpoll  LongpollConfig  `json:"longpoll"`
+}
+
+type RulesConfig struct {
+	// Files of regexes, applied in the order listed
+	Whitelists []string `json:"whitelists"`
+	Blacklists []string `json:"blacklists"`
+	// rules.WhitelistFirst or rules.BlacklistFirst
+	Order string `json:"order"`
+	// Where element hiding rules added from the settings page are saved,
+	// empty to only keep them in memory
+	CosmeticFile string `json:"cosmetic_file"`
+}
+
+type InjectionConfig struct {
+	// Inject the page controls into html pages
+	Enabled bool `json:"enabled"`
+}
+
+type BlockPageConfig struct {
+	// html/template files to use instead of the built-in block page and
+	// "can't rewrite url" page, empty for the built-in ones
+	Template       string `json:"template"`
+	BadUrlTemplate string `json:"bad_url_template"`
+}
+
+type LoggingConfig struct {
+	// Log every proxy request (goproxy's verbose logging)
+	Verbose bool `json:"verbose"`
+	// Log to this file instead of stderr
+	File string `json:"file"`
+}
+
+type StorageConfig struct {
+	// File to record request history in, empty to only keep it in memory
+	HistoryFile string `json:"history_file"`
+	// Max number of recent requests to keep in memory
+	HistorySize int `json:"history_size"`
+	// File to remember page control positions in, empty to only keep them
+	// in memory
+	ControlStateFile string `json:"control_state_file"`
+}
+
+type MitmConfig struct {
+	// Intercept https traffic.  When disabled https is tunneled as-is and
+	// only the host can be seen.
+	Enabled bool `json:"enabled"`
+	// CA certificate and key (PEM) used to sign intercepted sites'
+	// certificates.  Defaults to goproxy's built-in CA.
+	CACert string `json:"ca_cert"`
+	CAKey  string `json:"ca_key"`
+	// Hosts that are always tunneled without interception (banking, apps
+	// with pinned certificates), NO_PROXY style as in UpstreamConfig.NoProxy
+	NoMitmHosts []string `json:"no_mitm_hosts"`
+}
+
+type UpstreamConfig struct {
+	// Proxy url for outbound connections, empty for direct.  Either
+	// http://[user:pass@]host:port or socks5://[user:pass@]host:port
+	Default string `json:"default"`
+	// Hosts that always go direct, NO_PROXY style: example.com (and its
+	// subdomains), .example.com (subdomains only), 10.0.0.0/8, or *
+	NoProxy []string `json:"no_proxy"`
+	// Checked in order before NoProxy and Default, first match wins
+	Routes []UpstreamRoute `json:"routes"`
+}
+
+type UpstreamRoute struct {
+	// Same format as NoProxy
+	Hosts []string `json:"hosts"`
+	// Proxy url as in Default, or "direct"
+	Proxy string `json:"proxy"`
+}
+
+type TrackingConfig struct {
+	// Take tracking parameters out of urls before they're checked against
+	// the rules.  Pages are redirected to the cleaned url, other requests
+	// are rewritten without the browser knowing.
+	Enabled bool `json:"enabled"`
+	// Query parameters to remove, a trailing * matches any parameter
+	// starting with the rest (utm_*)
+	Params []string `json:"params"`
+	// Sites to leave some or all parameters on
+	Exceptions []TrackingException `json:"exceptions"`
+}
+
+type TrackingException struct {
+	// Same format as UpstreamConfig.NoProxy
+	Hosts []string `json:"hosts"`
+	// Parameters to leave on, same format as TrackingConfig.Params.  Empty
+	// to leave every parameter on.
+	Params []string `json:"params"`
+}
+
+type HeadersConfig struct {
+	// Change outgoing request headers per the policies below
+	Enabled bool `json:"enabled"`
+	// Applies to requests to hosts no site policy matches
+	Default HeaderPolicy `json:"default"`
+	// Checked in order against the request's host, first match wins
+	Sites []SiteHeaderPolicy `json:"sites"`
+}
+
+type HeaderPolicy struct {
+	// Cut the Referer down to the referring page's origin for requests to
+	// other sites
+	TrimReferer bool `json:"trim_referer"`
+	// Headers to remove, ie X-Client-Data
+	DropHeaders []string `json:"drop_headers"`
+	// Send these instead of the browser's own, empty to leave them alone.
+	// Sec-CH-UA client hints are removed along with a replaced User-Agent.
+	UserAgent      string `json:"user_agent"`
+	AcceptLanguage string `json:"accept_language"`
+	// Send DNT: 1 and Sec-GPC: 1
+	DoNotTrack           bool `json:"dnt"`
+	GlobalPrivacyControl bool `json:"gpc"`
+}
+
+// Same settings as HeaderPolicy, anything left out comes from the default
+// policy.  "drop_headers": [] drops nothing.
+type SiteHeaderPolicy struct {
+	// Same format as UpstreamConfig.NoProxy
+	Hosts                []string `json:"hosts"`
+	TrimReferer          *bool    `json:"trim_referer,omitempty"`
+	DropHeaders          []string `json:"drop_headers"`
+	UserAgent            *string  `json:"user_agent,omitempty"`
+	AcceptLanguage       *string  `json:"accept_language,omitempty"`
+	DoNotTrack           *bool    `json:"dnt,omitempty"`
+	GlobalPrivacyControl *bool    `json:"gpc,omitempty"`
+}
+
+type SocksConfig struct {
+	// Address to accept SOCKS5 connections on, empty to disable
+	ListenAddr string `json:"listen_addr"`
+}
+
+type PacConfig struct {
+	// Have the pac file (/proxy.pac and /wpad.dat on the control server)
+	// send hosts whitelisted by ||host rules direct, bypassing the proxy
+	// and page controls for them.  Hosts the user blocked a url on or
+	// turned javascript off for keep going thru the proxy, but the page
+	// controls never show up on the others, so nothing new can be blocked
+	// there until the whitelist rule is removed.
+	DirectWhitelistedHosts bool `json:"direct_whitelisted_hosts"`
+	// Also serve the pac file on this address, for other machines or WPAD
+	// discovery (0.0.0.0:80).  The control server only listens on
+	// 127.0.0.1.  Empty to disable.
+	ListenAddr string `json:"listen_addr"`
+}
+
+type DnsConfig struct {
+	// Address to answer DNS queries on (UDP and TCP), empty to disable
+	ListenAddr string `json:"listen_addr"`
+	// Resolver that queries for hosts that aren't blocked are forwarded to
+	Upstream string `json:"upstream"`
+	// "nxdomain" or "zero" (answer 0.0.0.0 / ::) for blocked hosts
+	BlockResponse string `json:"block_response"`
+}
+
+type LongpollConfig struct {
+	MaxTimeoutSeconds  int `json:"max_timeout_seconds"`
+	MaxEventBufferSize int `json:"max_event_buffer_size"`
+	EventTTLSeconds    int `json:"event_ttl_seconds"`
+}
+
+func Default() *Config {
+	return &Config{
+		ListenAddr:      "127.0.0.1:3128",
+		ControlPort:     "8380",
+		ExceptionString: "LOL-WHUT-JUST-DOIT-DOOD",
+		Rules: RulesConfig{
+			Whitelists: []string{"whitelist.txt"},
+			Blacklists: []string{"blacklist.txt"},
+			Order:      rules.WhitelistFirst,
+		},
+		Injection: InjectionConfig{Enabled: true},
+		Storage:   StorageConfig{HistorySize: 10000},
+		Mitm:      MitmConfig{Enabled: true, NoMitmHosts: []string{}},
+		Upstream: UpstreamConfig{
+			NoProxy: []string{"localhost", "127.0.0.1", "::1"},
+			Routes:  []UpstreamRoute{},
+		},
+		Tracking: TrackingConfig{
+			Enabled: false,
+			Params: []string{"utm_*", "fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid",
+				"yclid", "twclid", "ttclid", "igshid", "mc_cid", "mc_eid", "_hsenc", "_hsmi",
+				"mkt_tok", "oly_anon_id", "oly_enc_id", "vero_id"},
+			Exceptions: []TrackingException{},
+		},
+		Headers: HeadersConfig{
+			Enabled: false,
+			Default: HeaderPolicy{
+				TrimReferer:          true,
+				DropHeaders:          []string{"X-Client-Data"},
+				DoNotTrack:           true,
+				GlobalPrivacyControl: true,
+			},
+			Sites: []SiteHeaderPolicy{},
+		},
+		Dns: DnsConfig{
+			Upstream:      "1.1.1.1:53",
+			BlockResponse: DnsBlockNxdomain,
+		},
+		Longpoll: LongpollConfig{
+			MaxTimeoutSeconds:  120,
+			MaxEventBufferSize: 1000,
+			EventTTLSeconds:    240,
+		},
+	}
+}
+
+// Load settings from a JSON file on top of the defaults.  Settings missing
+// from the file keep their default values.
+func Load(filename string) (*Config, error) {
+	conf := Default()
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %v", filename, err)
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	// catch typos in setting names
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(conf); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", filename, err)
+	}
+	return conf, nil
+}
+
+func (c *Config) Validate() error {
+	if len(c.ListenAddr) == 0 {
+		return fmt.Errorf("listen_addr is required")
+	}
+	if len(c.ControlPort) == 0 {
+		return fmt.Errorf("control_port is required")
+	}
+	if len(c.ExceptionString) == 0 {
+		return fmt.Errorf("exception_string is required")
+	}
+	if c.Storage.HistorySize < 0 {
+		return fmt.Errorf("storage.history_size can't be negative, got: %d", c.Storage.HistorySize)
+	}
+	if c.Rules.Order != rules.WhitelistFirst && c.Rules.Order != rules.BlacklistFirst {
+		return fmt.Errorf("rules.order must be %q or %q, got: %q",
+			rules.WhitelistFirst, rules.BlacklistFirst, c.Rules.Order)
+	}
+	if c.Dns.BlockResponse != DnsBlockNxdomain && c.Dns.BlockResponse != DnsBlockZero {
+		return fmt.Errorf("dns.block_response must be %q or %q, got: %q",
+			DnsBlockNxdomain, DnsBlockZero, c.Dns.BlockResponse)
+	}
+	if len(c.Dns.ListenAddr) > 0 && len(c.Dns.Upstream) == 0 {
+		return fmt.Errorf("dns.upstream is required when dns.listen_addr is set")
+	}
+	if (len(c.Mitm.CACert) == 0) != (len(c.Mitm.CAKey) == 0) {
+		return fmt.Errorf("mitm.ca_cert and mitm.ca_key must be set together")
+	}
+	return nil
+}
+
+// Write the config as indented JSON, in the same format Load reads.
+func (c *Config) Write(w io.Writer) error {
+	out, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", out)
+	return err
+}
@@ -6,26 +6,44 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 
+	"github.com/jcuga/proxyblock/proxy/controlstate"
 	"github.com/jcuga/proxyblock/proxy/pagecontrols"
+	"github.com/jcuga/proxyblock/proxy/rules"
 	"github.com/jcuga/proxyblock/proxy/settings"
+	"github.com/jcuga/proxyblock/proxy/stats"
 )
 
 type HTTPServer struct {
 	port  string
 	https *http.Server // TODO: rename this from 'https' to something like 'server', this is unacceptably bad naming!
+	mux   *http.ServeMux
+}
+
+// Register an additional page on the control server, must be called before
+// Serve.
+func (s *HTTPServer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.mux.HandleFunc(pattern, handler)
 }
 
 func (s *HTTPServer) Serve() {
 	go s.https.ListenAndServe()
 }
 
-func NewControlServer(port string, eventAjaxHandler func(w http.ResponseWriter, r *http.Request), whiteListUpdates, blackListUpdates chan<- string) *HTTPServer {
-	s := &HTTPServer{port, &http.Server{Addr: "127.0.0.1:" + port, Handler: nil}}
+func NewControlServer(port string, eventAjaxHandler func(w http.ResponseWriter, r *http.Request), whiteListUpdates, blackListUpdates chan<- string,
+	getRulesReport func() *rules.Report, statsHandler func(w http.ResponseWriter, r *http.Request),
+	controlStates *controlstate.Store) *HTTPServer {
 	mux := http.NewServeMux()
-	mux.HandleFunc(pagecontrols.ProxyPageControlsUrl, pagecontrols.PageControlsHandler)
+	s := &HTTPServer{port, &http.Server{Addr: "127.0.0.1:" + port, Handler: nil}, mux}
+	mux.HandleFunc(pagecontrols.ProxyPageControlsUrl, pagecontrols.GetPageControlsHandler(controlStates))
+	mux.HandleFunc(controlstate.ControlStateUrl, controlStates.Handler)
+	mux.HandleFunc(controlstate.NoScriptUrl, controlStates.NoScriptHandler)
+	mux.Handle(pagecontrols.AssetsUrl, pagecontrols.AssetsHandler())
 	mux.HandleFunc("/events", eventAjaxHandler)
+	mux.HandleFunc(stats.StatsUrl, statsHandler)
 	mux.HandleFunc("/proxy-settings", settings.ProxySettingsHandler)
+	mux.HandleFunc(settings.RulesReportUrl, settings.GetRulesReportHandler(getRulesReport))
 	mux.HandleFunc("/add-wl", getAddListItemHandler(whiteListUpdates))
 	mux.HandleFunc("/add-bl", getAddListItemHandler(blackListUpdates))
 	// TODO: remove-wl url
@@ -44,6 +62,7 @@ func getAddListItemHandler(updateList chan<- string) func(http.ResponseWriter, *
 		if len(new_url) < 1 {
 			w.WriteHeader(http.StatusBadRequest)
 			fmt.Fprint(w, "400 Bad request.")
+			return
 		}
 		log.Printf("Adding item to white/black list: %s", new_url)
 		// send new url to proxy and it will add it to it's white/black list
@@ -52,7 +71,7 @@ func getAddListItemHandler(updateList chan<- string) func(http.ResponseWriter, *
 		// block page, then we'll want to let the user continue to the
 		// original page
 		continue_to := r.URL.Query().Get("continue_to_page")
-		if continue_to == "yes" {
+		if continue_to == "yes" && isWebUrl(new_url) {
 			http.Redirect(w, r, new_url, 301)
 		} else {
 			fmt.Fprint(w, "200 ok")
@@ -60,4 +79,10 @@ func getAddListItemHandler(updateList chan<- string) func(http.ResponseWriter, *
 	}
 }
 
+// Only redirect to web pages, never javascript: or data: urls
+func isWebUrl(rawUrl string) bool {
+	u, err := url.Parse(rawUrl)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
 // TODO: getRemoveListItemHandler
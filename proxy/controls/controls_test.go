@@ -0,0 +1,60 @@
+package controls
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestIsWebUrl(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"http://example.com/", true},
+		{"https://example.com/page?q=1", true},
+		{"HTTPS://example.com/", true},
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(document.cookie)", false},
+		{" javascript:alert(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==", false},
+		{"vbscript:msgbox(1)", false},
+		{"//evil.example/", false},
+		{"/relative", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := isWebUrl(test.url); got != test.want {
+			t.Errorf("isWebUrl(%q) = %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+// "Add to Whitelist and continue" only ever redirects to web pages
+func TestAddListItemContinuesToWebPagesOnly(t *testing.T) {
+	for _, test := range []struct {
+		url          string
+		wantRedirect bool
+	}{
+		{"https://example.com/ads.js", true},
+		{"javascript:alert(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+	} {
+		updates := make(chan string, 1)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/add-wl?continue_to_page=yes&url="+url.QueryEscape(test.url), nil)
+		getAddListItemHandler(updates)(rec, req)
+		if got := <-updates; got != test.url {
+			t.Errorf("%q: whitelisted %q", test.url, got)
+		}
+		location := rec.Header().Get("Location")
+		if test.wantRedirect && (rec.Code != http.StatusMovedPermanently || location != test.url) {
+			t.Errorf("%q: status %d Location %q, want a redirect to it", test.url, rec.Code, location)
+		}
+		if !test.wantRedirect && (rec.Code != http.StatusOK || len(location) > 0) {
+			t.Errorf("%q: status %d Location %q, want no redirect", test.url, rec.Code, location)
+		}
+	}
+}
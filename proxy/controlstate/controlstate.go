@@ -0,0 +1,253 @@
+package controlstate
+
+// Remembers how the user left the injected page controls (which corner,
+// expanded or not, shrunk down to an icon) so pages show them the same way
+// on the next load.  State is kept per site, plus a global default for sites
+// that don't have any yet (only changed by saving without a site).  Also
+// remembers the sites the user turned javascript off for.  Optionally saved to
+// a JSON file so it survives restarts.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jcuga/proxyblock/utils"
+)
+
+const (
+	ControlStateUrl = "/control-state"
+	NoScriptUrl     = "/no-script"
+
+	CornerRight = "right"
+	CornerLeft  = "left"
+)
+
+type State struct {
+	UpTop     bool   `json:"up_top"`
+	Expanded  bool   `json:"expanded"`
+	Corner    string `json:"corner"`
+	Collapsed bool   `json:"collapsed"`
+}
+
+// How the controls look before the user changes anything
+func DefaultState() State {
+	return State{UpTop: true, Corner: CornerRight}
+}
+
+type fileContents struct {
+	Global State            `json:"global"`
+	Sites  map[string]State `json:"sites"`
+	// Sites with javascript turned off
+	NoScript []string `json:"no_script_sites,omitempty"`
+}
+
+type Store struct {
+	mu       sync.Mutex
+	global   State
+	sites    map[string]State
+	noScript map[string]bool
+	filename string
+}
+
+// Create a store that only keeps state in memory
+func New() *Store {
+	return &Store{global: DefaultState(), sites: make(map[string]State), noScript: make(map[string]bool)}
+}
+
+// Create a store backed by filename, loading whatever is already saved there.
+func Open(filename string) (*Store, error) {
+	s := New()
+	s.filename = filename
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	contents := fileContents{Global: DefaultState()}
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", filename, err)
+	}
+	s.global = contents.Global.normalized()
+	for site, state := range contents.Sites {
+		s.sites[site] = state.normalized()
+	}
+	for _, site := range contents.NoScript {
+		if key := siteKey(site); len(key) > 0 {
+			s.noScript[key] = true
+		}
+	}
+	return s, nil
+}
+
+// The state for site (a hostname), or the global default if it has none
+func (s *Store) Get(site string) State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.sites[siteKey(site)]; ok {
+		return state
+	}
+	return s.global
+}
+
+// Remember state for site, or as the default for sites without their own if
+// no site is given.
+func (s *Store) Set(site string, state State) error {
+	state = state.normalized()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key := siteKey(site); len(key) > 0 {
+		s.sites[key] = state
+	} else {
+		s.global = state
+	}
+	return s.save()
+}
+
+// Whether the user turned javascript off for site
+func (s *Store) ScriptsDisabled(site string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.noScript[siteKey(site)]
+}
+
+// Sites the user turned javascript off for
+func (s *Store) NoScriptSites() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sites := make([]string, 0, len(s.noScript))
+	for site := range s.noScript {
+		sites = append(sites, site)
+	}
+	return sites
+}
+
+// Turn javascript off (or back on) for site.  Unlike the controls' state this
+// never carries over to other sites.
+func (s *Store) SetScriptsDisabled(site string, disabled bool) error {
+	key := siteKey(site)
+	if len(key) == 0 {
+		return fmt.Errorf("no site given")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if disabled {
+		s.noScript[key] = true
+	} else {
+		delete(s.noScript, key)
+	}
+	return s.save()
+}
+
+// Write everything to the file (if any), must hold mu.
+func (s *Store) save() error {
+	if len(s.filename) == 0 {
+		return nil
+	}
+	noScript := make([]string, 0, len(s.noScript))
+	for site := range s.noScript {
+		noScript = append(noScript, site)
+	}
+	sort.Strings(noScript)
+	data, err := json.MarshalIndent(fileContents{s.global, s.sites, noScript}, "", "    ")
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash can't leave a half written file
+	tmp, err := ioutil.TempFile(filepath.Dir(s.filename), filepath.Base(s.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.filename)
+}
+
+// Serves a site's state as JSON on GET, and saves it on POST.  The site is
+// given by the "site" query parameter, state fields as form values.  Without
+// a site the global default is served or saved.
+func (s *Store) Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	site := r.URL.Query().Get("site")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !utils.IsSameOrigin(r) {
+			http.Error(w, "403 Forbidden.", http.StatusForbidden)
+			return
+		}
+		state := State{
+			UpTop:     r.FormValue("up_top") == "true",
+			Expanded:  r.FormValue("expanded") == "true",
+			Corner:    r.FormValue("corner"),
+			Collapsed: r.FormValue("collapsed") == "true",
+		}
+		if err := s.Set(site, state); err != nil {
+			log.Printf("ERROR: failed to save page control state.  error: %q", err)
+		}
+	default:
+		http.Error(w, "405 Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Get(site)); err != nil {
+		log.Printf("ERROR: failed to write page control state.  error: %q", err)
+	}
+}
+
+// Serves whether javascript is off for a site as JSON ({"disabled": true}) on
+// GET, and turns it off or on with the "disabled" form value on POST.  The
+// site is given by the "site" query parameter.
+func (s *Store) NoScriptHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	site := r.URL.Query().Get("site")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !utils.IsSameOrigin(r) {
+			http.Error(w, "403 Forbidden.", http.StatusForbidden)
+			return
+		}
+		if len(siteKey(site)) == 0 {
+			http.Error(w, "400 Bad request.", http.StatusBadRequest)
+			return
+		}
+		if err := s.SetScriptsDisabled(site, r.FormValue("disabled") == "true"); err != nil {
+			log.Printf("ERROR: failed to save javascript setting.  error: %q", err)
+		}
+	default:
+		http.Error(w, "405 Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]bool{"disabled": s.ScriptsDisabled(site)}); err != nil {
+		log.Printf("ERROR: failed to write javascript setting.  error: %q", err)
+	}
+}
+
+func (state State) normalized() State {
+	if state.Corner != CornerLeft {
+		state.Corner = CornerRight
+	}
+	return state
+}
+
+func siteKey(site string) string {
+	return strings.ToLower(strings.TrimSpace(site))
+}
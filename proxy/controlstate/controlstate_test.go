@@ -0,0 +1,79 @@
+package controlstate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSetKeepsSitesApart(t *testing.T) {
+	s := New()
+	moved := State{UpTop: false, Expanded: true, Corner: CornerLeft, Collapsed: true}
+	if err := s.Set("example.com", moved); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Get("EXAMPLE.com"); got != moved {
+		t.Errorf("Get(site) = %+v, want %+v", got, moved)
+	}
+	if got := s.Get("other.com"); got != DefaultState() {
+		t.Errorf("Get(other site) = %+v, want the default %+v", got, DefaultState())
+	}
+	if err := s.Set("", moved); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Get("other.com"); got != moved {
+		t.Errorf("Get(other site) after saving the default = %+v, want %+v", got, moved)
+	}
+}
+
+func post(handler http.HandlerFunc, target string, form url.Values, header http.Header) int {
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec.Code
+}
+
+// Other sites can post forms to the control server, they mustn't change anything
+func TestHandlersRejectOtherOrigins(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+	}{
+		{"no origin", http.Header{}, http.StatusOK},
+		{"control page", http.Header{"Origin": {"http://127.0.0.1:8380"}}, http.StatusOK},
+		{"control page referer", http.Header{"Referer": {"http://127.0.0.1:8380/page-controls"}}, http.StatusOK},
+		{"other site", http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden},
+		{"other site referer", http.Header{"Referer": {"https://evil.example/form"}}, http.StatusForbidden},
+		{"null origin", http.Header{"Origin": {"null"}}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := New()
+			code := post(s.Handler, ControlStateUrl+"?site=victim.com",
+				url.Values{"corner": {CornerLeft}}, test.header)
+			if code != test.want {
+				t.Errorf("%s status = %d, want %d", ControlStateUrl, code, test.want)
+			}
+			changed := s.Get("victim.com") != DefaultState()
+			if changed != (test.want == http.StatusOK) {
+				t.Errorf("%s changed state = %v, status %d", ControlStateUrl, changed, code)
+			}
+
+			code = post(s.NoScriptHandler, NoScriptUrl+"?site=victim.com",
+				url.Values{"disabled": {"true"}}, test.header)
+			if code != test.want {
+				t.Errorf("%s status = %d, want %d", NoScriptUrl, code, test.want)
+			}
+			if disabled := s.ScriptsDisabled("victim.com"); disabled != (test.want == http.StatusOK) {
+				t.Errorf("%s turned javascript off = %v, status %d", NoScriptUrl, disabled, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package cosmetic
+
+// Element hiding: blocked ads leave empty boxes and "advertisement" labels
+// behind, so pages get a <style> block that hides whatever the cosmetic rules
+// for the site (see rules.CosmeticRule) point at.  Rules come from the rule
+// files, plus whatever the user adds from the settings page, which can be
+// saved to a rule file of their own.
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jcuga/proxyblock/proxy/rules"
+)
+
+type Filter struct {
+	mu sync.RWMutex
+	// From the rule files, read-only
+	fileRules []*rules.CosmeticRule
+	// Added from the settings page
+	userRules []*rules.CosmeticRule
+	// Where userRules are saved, if anywhere
+	filename string
+}
+
+// Create a filter with the rules from the rule files.
+func New(fileRules []*rules.CosmeticRule) *Filter {
+	return &Filter{fileRules: fileRules}
+}
+
+// Keep user added rules in filename, loading whatever is already there.
+func (f *Filter) OpenUserRules(filename string) error {
+	file, err := os.Open(filename)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.filename = filename
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		r, err := rules.ParseCosmeticRule(line)
+		if err != nil && strings.HasPrefix(line, "#") {
+			// comment
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", filename, lineNum, err)
+		}
+		r.File, r.Line = filename, lineNum
+		f.userRules = append(f.userRules, r)
+	}
+	return scanner.Err()
+}
+
+// The rules from the rule files and the ones the user added
+func (f *Filter) Rules() ([]*rules.CosmeticRule, []*rules.CosmeticRule) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.fileRules, append([]*rules.CosmeticRule(nil), f.userRules...)
+}
+
+// Add a rule written as it would be in a rule file, ie example.com##.ad
+func (f *Filter) Add(line string) error {
+	r, err := rules.ParseCosmeticRule(line)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, existing := range f.userRules {
+		if existing.Pattern == r.Pattern {
+			return nil
+		}
+	}
+	f.userRules = append(f.userRules, r)
+	return f.save()
+}
+
+// Remove a user added rule, by its pattern
+func (f *Filter) Remove(pattern string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	kept := f.userRules[:0]
+	for _, r := range f.userRules {
+		if r.Pattern != pattern {
+			kept = append(kept, r)
+		}
+	}
+	f.userRules = kept
+	return f.save()
+}
+
+// The selectors to hide on hostname, in rule order
+func (f *Filter) Selectors(hostname string) []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var selectors []string
+	excepted := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, list := range [][]*rules.CosmeticRule{f.fileRules, f.userRules} {
+		for _, r := range list {
+			if r.Exception && r.AppliesTo(hostname) {
+				excepted[r.Selector] = true
+			}
+		}
+	}
+	for _, list := range [][]*rules.CosmeticRule{f.fileRules, f.userRules} {
+		for _, r := range list {
+			if r.Exception || excepted[r.Selector] || seen[r.Selector] || !r.AppliesTo(hostname) {
+				continue
+			}
+			seen[r.Selector] = true
+			selectors = append(selectors, r.Selector)
+		}
+	}
+	return selectors
+}
+
+// CSS hiding everything that should be hidden on hostname, empty if there's
+// nothing to hide.  Each selector gets its own rule, so one the browser
+// doesn't understand doesn't take the rest down with it.
+func (f *Filter) Stylesheet(hostname string) string {
+	var css strings.Builder
+	for _, s := range f.Selectors(hostname) {
+		css.WriteString(s)
+		css.WriteString(" { display: none !important; }\n")
+	}
+	return css.String()
+}
+
+// Write the user rules to the file (if any), must hold mu.
+func (f *Filter) save() error {
+	if len(f.filename) == 0 {
+		return nil
+	}
+	var out strings.Builder
+	out.WriteString("# Element hiding rules added from the proxyblock settings page\n")
+	for _, r := range f.userRules {
+		out.WriteString(r.Pattern)
+		out.WriteString("\n")
+	}
+	// write then rename so a crash can't leave a half written file
+	tmp, err := ioutil.TempFile(filepath.Dir(f.filename), filepath.Base(f.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(out.String()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.filename)
+}
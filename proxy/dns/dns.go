@@ -0,0 +1,203 @@
+package dns
+
+// An optional DNS server for apps that ignore the proxy settings.  Queries for
+// hosts blocked by ||host rules are answered with NXDOMAIN (or 0.0.0.0 / ::),
+// everything else is forwarded as-is to an upstream resolver.  Listens on both
+// UDP and TCP.
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/jcuga/proxyblock/proxy/config"
+)
+
+var upstreamTimeout = 5 * time.Second
+
+type Server struct {
+	addr     string
+	upstream string
+	// config.DnsBlockNxdomain or config.DnsBlockZero
+	blockResponse string
+	// Called with the queried host, returns true to block it
+	isBlocked func(host string) bool
+}
+
+func NewServer(addr, upstream, blockResponse string, isBlocked func(host string) bool) *Server {
+	return &Server{addr: addr, upstream: upstream, blockResponse: blockResponse, isBlocked: isBlocked}
+}
+
+// Start serving UDP and TCP in the background.
+func (s *Server) Serve() {
+	packetConn, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		log.Printf("ERROR: failed to start DNS server (udp).  error: %q", err)
+		return
+	}
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		log.Printf("ERROR: failed to start DNS server (tcp).  error: %q", err)
+		packetConn.Close()
+		return
+	}
+	log.Printf("Starting DNS server on: %s (upstream: %s)", s.addr, s.upstream)
+	go s.serveUdp(packetConn)
+	go s.serveTcp(ln)
+}
+
+func (s *Server) serveUdp(conn net.PacketConn) {
+	for {
+		buf := make([]byte, 65535)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("ERROR: DNS udp read failed.  error: %q", err)
+			return
+		}
+		go func(query []byte) {
+			if resp := s.answer(query, "udp"); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}(buf[:n])
+	}
+}
+
+func (s *Server) serveTcp(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("ERROR: DNS tcp accept failed.  error: %q", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+				query, err := readTcpMessage(conn)
+				if err != nil {
+					return
+				}
+				resp := s.answer(query, "tcp")
+				if resp == nil || writeTcpMessage(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Answer a query ourselves if it's for a blocked host, otherwise ask
+// upstream.  Returns nil if there's nothing to send back.
+func (s *Server) answer(query []byte, network string) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err == nil {
+		host := strings.TrimSuffix(question.Name.String(), ".")
+		if s.isBlocked(host) {
+			resp, buildErr := s.blockedResponse(header, question)
+			if buildErr != nil {
+				log.Printf("ERROR: failed to build DNS response.  error: %q", buildErr)
+				return nil
+			}
+			return resp
+		}
+	}
+	resp, err := s.forward(query, network)
+	if err != nil {
+		log.Printf("ERROR: DNS upstream query failed.  error: %q", err)
+		return nil
+	}
+	return resp
+}
+
+func (s *Server) blockedResponse(query dnsmessage.Header, question dnsmessage.Question) ([]byte, error) {
+	header := dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		OpCode:             query.OpCode,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              dnsmessage.RCodeSuccess,
+	}
+	if s.blockResponse != config.DnsBlockZero {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+	builder := dnsmessage.NewBuilder(make([]byte, 0, 512), header)
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if s.blockResponse == config.DnsBlockZero {
+		answerHeader := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: question.Class, TTL: 60}
+		switch question.Type {
+		case dnsmessage.TypeA:
+			if err := builder.AResource(answerHeader, dnsmessage.AResource{}); err != nil {
+				return nil, err
+			}
+		case dnsmessage.TypeAAAA:
+			if err := builder.AAAAResource(answerHeader, dnsmessage.AAAAResource{}); err != nil {
+				return nil, err
+			}
+		}
+		// other types get an empty (no data) answer
+	}
+	return builder.Finish()
+}
+
+func (s *Server) forward(query []byte, network string) ([]byte, error) {
+	conn, err := net.DialTimeout(network, s.upstream, upstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+	if network == "tcp" {
+		if err := writeTcpMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTcpMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// DNS over TCP prefixes each message with its length
+func readTcpMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTcpMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
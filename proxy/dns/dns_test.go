@@ -0,0 +1,110 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/jcuga/proxyblock/proxy/config"
+)
+
+func query(t *testing.T, host string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	if err := builder.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	err := builder.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(host + "."),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func isBlocked(host string) bool {
+	return host == "ads.example.com"
+}
+
+func TestBlockedAnswers(t *testing.T) {
+	tests := []struct {
+		blockResponse string
+		qtype         dnsmessage.Type
+		wantRCode     dnsmessage.RCode
+		// the one answer's A or AAAA address, nil for no answers
+		wantAddr []byte
+	}{
+		{config.DnsBlockNxdomain, dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{config.DnsBlockNxdomain, dnsmessage.TypeAAAA, dnsmessage.RCodeNameError, nil},
+		{config.DnsBlockZero, dnsmessage.TypeA, dnsmessage.RCodeSuccess, make([]byte, 4)},
+		{config.DnsBlockZero, dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, make([]byte, 16)},
+		{config.DnsBlockZero, dnsmessage.TypeTXT, dnsmessage.RCodeSuccess, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.blockResponse+" "+test.qtype.String(), func(t *testing.T) {
+			// nothing should be forwarded
+			s := NewServer("", "127.0.0.1:1", test.blockResponse, isBlocked)
+			resp := s.answer(query(t, "ads.example.com", test.qtype), "udp")
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatalf("unpacking answer: %v", err)
+			}
+			if msg.ID != 42 || !msg.Response || msg.RCode != test.wantRCode {
+				t.Errorf("header = %+v, want a response to 42 with %v", msg.Header, test.wantRCode)
+			}
+			if len(msg.Questions) != 1 || msg.Questions[0].Type != test.qtype {
+				t.Errorf("questions = %+v", msg.Questions)
+			}
+			if test.wantAddr == nil {
+				if len(msg.Answers) > 0 {
+					t.Errorf("answers = %+v, want none", msg.Answers)
+				}
+				return
+			}
+			if len(msg.Answers) != 1 {
+				t.Fatalf("answers = %+v, want one", msg.Answers)
+			}
+			var addr []byte
+			switch body := msg.Answers[0].Body.(type) {
+			case *dnsmessage.AResource:
+				addr = body.A[:]
+			case *dnsmessage.AAAAResource:
+				addr = body.AAAA[:]
+			}
+			if !net.IP(addr).Equal(net.IP(test.wantAddr)) {
+				t.Errorf("answer = %+v, want %v", msg.Answers[0].Body, net.IP(test.wantAddr))
+			}
+		})
+	}
+}
+
+func TestOtherHostsForwarded(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := upstream.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// echo the query back as the answer
+		upstream.WriteTo(buf[:n], addr)
+	}()
+
+	s := NewServer("", upstream.LocalAddr().String(), config.DnsBlockNxdomain, isBlocked)
+	q := query(t, "www.example.com", dnsmessage.TypeA)
+	if resp := s.answer(q, "udp"); string(resp) != string(q) {
+		t.Errorf("got %x, want upstream's answer %x", resp, q)
+	}
+}
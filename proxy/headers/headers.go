@@ -0,0 +1,149 @@
+package headers
+
+// Changes what outgoing requests say about the browser: Referers to other
+// sites are cut down to the referring page's origin, fingerprinting headers
+// like X-Client-Data are dropped, User-Agent and Accept-Language can be
+// replaced with something common, and DNT / Sec-GPC are added.  There's a
+// default policy plus policies for sites (by the request's host), see
+// config.HeadersConfig.
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+
+	"github.com/jcuga/proxyblock/proxy/config"
+	"github.com/jcuga/proxyblock/utils"
+)
+
+type sitePolicy struct {
+	hosts  utils.HostList
+	policy config.HeaderPolicy
+}
+
+type Policies struct {
+	defaultPolicy config.HeaderPolicy
+	sites         []sitePolicy
+}
+
+func NewPolicies(conf config.HeadersConfig) (*Policies, error) {
+	if err := checkPolicy(conf.Default); err != nil {
+		return nil, fmt.Errorf("headers.default: %v", err)
+	}
+	p := &Policies{defaultPolicy: conf.Default}
+	for i, sc := range conf.Sites {
+		policy := conf.Default
+		if sc.TrimReferer != nil {
+			policy.TrimReferer = *sc.TrimReferer
+		}
+		if sc.DropHeaders != nil {
+			policy.DropHeaders = sc.DropHeaders
+		}
+		if sc.UserAgent != nil {
+			policy.UserAgent = *sc.UserAgent
+		}
+		if sc.AcceptLanguage != nil {
+			policy.AcceptLanguage = *sc.AcceptLanguage
+		}
+		if sc.DoNotTrack != nil {
+			policy.DoNotTrack = *sc.DoNotTrack
+		}
+		if sc.GlobalPrivacyControl != nil {
+			policy.GlobalPrivacyControl = *sc.GlobalPrivacyControl
+		}
+		if err := checkPolicy(policy); err != nil {
+			return nil, fmt.Errorf("headers.sites[%d]: %v", i, err)
+		}
+		p.sites = append(p.sites, sitePolicy{hosts: utils.ParseHostList(sc.Hosts), policy: policy})
+	}
+	return p, nil
+}
+
+// The policy for requests to hostname
+func (p *Policies) For(hostname string) config.HeaderPolicy {
+	for _, s := range p.sites {
+		if s.hosts.Matches(hostname) {
+			return s.policy
+		}
+	}
+	return p.defaultPolicy
+}
+
+// Change req's headers per the policy for its host
+func (p *Policies) Apply(req *http.Request) {
+	policy := p.For(req.URL.Hostname())
+	for _, name := range policy.DropHeaders {
+		req.Header.Del(name)
+	}
+	if policy.TrimReferer {
+		trimReferer(req)
+	}
+	if len(policy.UserAgent) > 0 {
+		req.Header.Set("User-Agent", policy.UserAgent)
+		// client hints would give away what the User-Agent no longer does
+		for name := range req.Header {
+			if strings.HasPrefix(name, "Sec-Ch-Ua") {
+				req.Header.Del(name)
+			}
+		}
+	}
+	if len(policy.AcceptLanguage) > 0 {
+		req.Header.Set("Accept-Language", policy.AcceptLanguage)
+	}
+	if policy.DoNotTrack {
+		req.Header.Set("DNT", "1")
+	}
+	if policy.GlobalPrivacyControl {
+		req.Header.Set("Sec-GPC", "1")
+	}
+}
+
+// Only the origin of the referring page goes to other sites.  Referers that
+// can't be parsed don't go anywhere.
+func trimReferer(req *http.Request) {
+	referer := req.Header.Get("Referer")
+	if len(referer) == 0 {
+		return
+	}
+	u, err := url.Parse(referer)
+	if err != nil || len(u.Host) == 0 {
+		req.Header.Del("Referer")
+		return
+	}
+	if site(u.Hostname()) == site(req.URL.Hostname()) {
+		return
+	}
+	req.Header.Set("Referer", u.Scheme+"://"+u.Host+"/")
+}
+
+// The registrable domain of hostname (example.co.uk for www.example.co.uk), or
+// the hostname itself for ips and the like
+func site(hostname string) string {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if net.ParseIP(hostname) != nil {
+		return hostname
+	}
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(hostname); err == nil {
+		return domain
+	}
+	return hostname
+}
+
+func checkPolicy(policy config.HeaderPolicy) error {
+	for _, name := range policy.DropHeaders {
+		if len(name) == 0 || strings.ContainsAny(name, " \t:\r\n") {
+			return fmt.Errorf("invalid header name in drop_headers: %q", name)
+		}
+	}
+	if strings.ContainsAny(policy.UserAgent, "\r\n") {
+		return fmt.Errorf("invalid user_agent: %q", policy.UserAgent)
+	}
+	if strings.ContainsAny(policy.AcceptLanguage, "\r\n") {
+		return fmt.Errorf("invalid accept_language: %q", policy.AcceptLanguage)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package headers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jcuga/proxyblock/proxy/config"
+)
+
+func TestTrimReferer(t *testing.T) {
+	p, err := NewPolicies(config.HeadersConfig{Default: config.HeaderPolicy{TrimReferer: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url     string
+		referer string
+		want    string
+	}{
+		// other sites only get the origin
+		{"http://ads.example.net/x.js", "https://www.example.com/private/page?q=1", "https://www.example.com/"},
+		{"http://tracker.com/p", "http://example.co.uk:8080/a", "http://example.co.uk:8080/"},
+		// same site, subdomains included, keeps it all
+		{"http://cdn.example.com/x.js", "https://www.example.com/page?q=1", "https://www.example.com/page?q=1"},
+		{"http://www.example.co.uk/", "http://shop.example.co.uk/a", "http://shop.example.co.uk/a"},
+		// different sites under the same public suffix
+		{"http://b.github.io/", "http://a.github.io/page", "http://a.github.io/"},
+		{"http://10.0.0.2/", "http://10.0.0.1/page", "http://10.0.0.1/"},
+		{"http://example.com/", "not a url", ""},
+		{"http://example.com/", "", ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		if len(test.referer) > 0 {
+			req.Header.Set("Referer", test.referer)
+		}
+		p.Apply(req)
+		if got := req.Header.Get("Referer"); got != test.want {
+			t.Errorf("%s from %q: Referer = %q, want %q", test.url, test.referer, got, test.want)
+		}
+	}
+}
+
+func TestSitePolicies(t *testing.T) {
+	off := false
+	ua := "Mozilla/5.0"
+	p, err := NewPolicies(config.HeadersConfig{
+		Default: config.HeaderPolicy{
+			TrimReferer:          true,
+			DropHeaders:          []string{"X-Client-Data"},
+			UserAgent:            ua,
+			DoNotTrack:           true,
+			GlobalPrivacyControl: true,
+		},
+		Sites: []config.SiteHeaderPolicy{
+			{Hosts: []string{"bank.example.com"}, TrimReferer: &off, UserAgent: new(string), DropHeaders: []string{}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "http://www.example.org/", nil)
+	req.Header.Set("Referer", "http://other.com/page")
+	req.Header.Set("X-Client-Data", "abc")
+	req.Header.Set("User-Agent", "Browser/1.0 (Rare OS)")
+	req.Header.Set("Sec-Ch-Ua-Platform", "Rare OS")
+	p.Apply(req)
+	for name, want := range map[string]string{
+		"Referer":            "http://other.com/",
+		"X-Client-Data":      "",
+		"User-Agent":         ua,
+		"Sec-Ch-Ua-Platform": "",
+		"Dnt":                "1",
+		"Sec-Gpc":            "1",
+	} {
+		if got := req.Header.Get(name); got != want {
+			t.Errorf("default policy: %s = %q, want %q", name, got, want)
+		}
+	}
+
+	req = httptest.NewRequest("GET", "http://bank.example.com/", nil)
+	req.Header.Set("Referer", "http://other.com/page")
+	req.Header.Set("X-Client-Data", "abc")
+	req.Header.Set("User-Agent", "Browser/1.0")
+	p.Apply(req)
+	for name, want := range map[string]string{
+		"Referer":       "http://other.com/page",
+		"X-Client-Data": "abc",
+		"User-Agent":    "Browser/1.0",
+		"Dnt":           "1",
+	} {
+		if got := req.Header.Get(name); got != want {
+			t.Errorf("site policy: %s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestNewPoliciesRejectsBadHeaders(t *testing.T) {
+	for _, policy := range []config.HeaderPolicy{
+		{DropHeaders: []string{""}},
+		{DropHeaders: []string{"X-Bad: 1"}},
+		{UserAgent: "x\r\nX-Injected: 1"},
+		{AcceptLanguage: "en\n"},
+	} {
+		if _, err := NewPolicies(config.HeadersConfig{Default: policy}); err == nil {
+			t.Errorf("NewPolicies(%+v) didn't fail", policy)
+		}
+	}
+}
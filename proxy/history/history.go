@@ -0,0 +1,134 @@
+package history
+
+// Keeps a record of requests handled by the proxy so they can be replayed
+// later, for example to see how the current rules would treat them.
+// Recent requests are kept in memory and are optionally appended to a file so
+// they survive restarts.
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Entry struct {
+	Time    time.Time
+	Action  string
+	Url     string
+	Referer string
+}
+
+type History struct {
+	mu      sync.Mutex
+	entries []Entry
+	// next slot to write to once entries is full
+	next    int
+	maxSize int
+	file    *os.File
+}
+
+// Create an in-memory history that keeps the most recent maxSize entries.
+func New(maxSize int) *History {
+	return &History{entries: make([]Entry, 0, maxSize), maxSize: maxSize}
+}
+
+// Create a history backed by filename.  Existing entries in the file are
+// loaded and new entries are appended to it.
+func Open(filename string, maxSize int) (*History, error) {
+	h := New(maxSize)
+	existing, err := ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range existing {
+		h.add(e)
+	}
+	h.file, err = os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %v", filename, err)
+	}
+	return h, nil
+}
+
+// Read all entries from a history file.
+// Each line is: timestamp<TAB>action<TAB>url<TAB>referer
+func ReadFile(filename string) ([]Entry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := make([]Entry, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 4 {
+			continue
+		}
+		t, tErr := time.Parse(time.RFC3339, fields[0])
+		if tErr != nil {
+			continue
+		}
+		entries = append(entries, Entry{Time: t, Action: fields[1], Url: fields[2], Referer: fields[3]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", filename, err)
+	}
+	return entries, nil
+}
+
+func (h *History) Add(e Entry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.add(e)
+	if h.file != nil {
+		if _, err := fmt.Fprintf(h.file, "%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339),
+			clean(e.Action), clean(e.Url), clean(e.Referer)); err != nil {
+			log.Printf("ERROR: failed to write request history.  error: %q", err)
+		}
+	}
+}
+
+func (h *History) add(e Entry) {
+	if h.maxSize <= 0 {
+		return
+	}
+	if len(h.entries) < h.maxSize {
+		h.entries = append(h.entries, e)
+		return
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % h.maxSize
+}
+
+// All entries currently kept in memory, oldest first.
+func (h *History) Entries() []Entry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := make([]Entry, 0, len(h.entries))
+	entries = append(entries, h.entries[h.next:]...)
+	entries = append(entries, h.entries[:h.next]...)
+	return entries
+}
+
+// Urls of all entries currently kept in memory, oldest first.
+func (h *History) Urls() []string {
+	return Urls(h.Entries())
+}
+
+func Urls(entries []Entry) []string {
+	urls := make([]string, len(entries))
+	for i, e := range entries {
+		urls[i] = e.Url
+	}
+	return urls
+}
+
+// keep fields from breaking the line based file format
+func clean(s string) string {
+	return strings.NewReplacer("\t", " ", "\n", " ", "\r", " ").Replace(s)
+}
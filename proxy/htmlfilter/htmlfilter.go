@@ -0,0 +1,308 @@
+package htmlfilter
+
+// Streams html responses thru an html tokenizer, leaving out the elements and
+// attributes that the page's html filters (see rules.HtmlFilterRule) ask for.
+// Everything else is passed along byte for byte.  Only an element whose text
+// decides whether it goes (:has-text) is held in memory, and only until its
+// end tag.
+
+import (
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"github.com/jcuga/proxyblock/proxy/rules"
+)
+
+var (
+	// Elements held for :has-text bigger than this are let thru as-is
+	MaxHoldBytes = 1 << 20
+)
+
+// Elements that never have an end tag
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "keygen": true, "link": true, "meta": true, "param": true, "source": true,
+	"track": true, "wbr": true,
+}
+
+type Reader struct {
+	src       io.ReadCloser
+	tokenizer *html.Tokenizer
+	// By tag name, and the attribute filters
+	elementFilters map[string][]*rules.HtmlFilterRule
+	attrFilters    []*rules.HtmlFilterRule
+	// Whether the url rules block an element's src
+	isBlocked func(src string) bool
+	// Ready to be returned by Read
+	out []byte
+	err error
+	// The element being left out and how deep into it we are
+	removing      string
+	removingDepth int
+	// The element being held until its end tag, to check its text against
+	// holdFilters
+	holding     string
+	holdDepth   int
+	held        []byte
+	heldText    strings.Builder
+	holdFilters []*rules.HtmlFilterRule
+	// Elements and attributes left out so far
+	removed int
+	// Called once the whole page has been filtered (or reading it failed)
+	finished func(removed int, err error)
+}
+
+// Filter src with the filters that apply to the page (exceptions already taken
+// out, see ForSite).  isBlocked says whether the url rules block an element's
+// src for :blocked-src filters.  finished, if given, is called at the end of
+// the page with how many elements and attributes were removed.
+func NewReader(src io.ReadCloser, filters []*rules.HtmlFilterRule, isBlocked func(src string) bool,
+	finished func(removed int, err error)) *Reader {
+	r := &Reader{
+		src:            src,
+		tokenizer:      html.NewTokenizer(src),
+		elementFilters: make(map[string][]*rules.HtmlFilterRule),
+		isBlocked:      isBlocked,
+		finished:       finished,
+	}
+	for _, f := range filters {
+		if len(f.Tag) > 0 {
+			r.elementFilters[f.Tag] = append(r.elementFilters[f.Tag], f)
+		} else {
+			r.attrFilters = append(r.attrFilters, f)
+		}
+	}
+	return r
+}
+
+// The filters that apply on hostname, minus the ones cancelled there by
+// exceptions.
+func ForSite(filters []*rules.HtmlFilterRule, hostname string) []*rules.HtmlFilterRule {
+	excepted := make(map[string]bool)
+	for _, f := range filters {
+		if f.Exception && f.AppliesTo(hostname) {
+			excepted[f.Filter] = true
+		}
+	}
+	var applies []*rules.HtmlFilterRule
+	for _, f := range filters {
+		if !f.Exception && !excepted[f.Filter] && f.AppliesTo(hostname) {
+			applies = append(applies, f)
+		}
+	}
+	return applies
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.step()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *Reader) Close() error {
+	return r.src.Close()
+}
+
+func (r *Reader) step() {
+	tokenType := r.tokenizer.Next()
+	if tokenType == html.ErrorToken {
+		// whatever was held didn't get its end tag, so it stays, along with
+		// any partial tag at the end of the page
+		r.out = append(r.out, r.held...)
+		r.held = nil
+		r.err = r.tokenizer.Err()
+		if r.err == io.EOF && len(r.removing) == 0 {
+			r.out = append(r.out, r.tokenizer.Raw()...)
+		}
+		if r.finished != nil {
+			err := r.err
+			if err == io.EOF {
+				err = nil
+			}
+			r.finished(r.removed, err)
+		}
+		return
+	}
+	// Raw's bytes get overwritten by Text's unescaping, so copy them first
+	raw := append([]byte(nil), r.tokenizer.Raw()...)
+	// The tokenizer only hands out a tag's name once
+	var tag string
+	var hasAttr bool
+	switch tokenType {
+	case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+		var name []byte
+		name, hasAttr = r.tokenizer.TagName()
+		tag = string(name)
+	}
+
+	if len(r.removing) > 0 {
+		r.skip(tokenType, tag)
+		return
+	}
+	if len(r.holding) > 0 && r.hold(tokenType, tag, raw) {
+		return
+	}
+
+	switch tokenType {
+	case html.StartTagToken, html.SelfClosingTagToken:
+		r.startTag(tokenType, tag, hasAttr, raw)
+	default:
+		r.emit(raw)
+	}
+}
+
+// Leave out the tokens of the element being removed
+func (r *Reader) skip(tokenType html.TokenType, tag string) {
+	switch tokenType {
+	case html.StartTagToken:
+		if tag == r.removing {
+			r.removingDepth++
+		}
+	case html.EndTagToken:
+		switch tag {
+		case r.removing:
+			r.removingDepth--
+		case "body", "html":
+			// the element was never closed, don't take the rest of the
+			// page with it
+			r.removingDepth = 0
+			r.emit(append([]byte(nil), r.tokenizer.Raw()...))
+		}
+	}
+	if r.removingDepth == 0 {
+		r.removing = ""
+	}
+}
+
+// Keep track of the element being held, returns true if the token was taken
+// care of.
+func (r *Reader) hold(tokenType html.TokenType, tag string, raw []byte) bool {
+	switch tokenType {
+	case html.TextToken:
+		r.heldText.Write(r.tokenizer.Text())
+	case html.StartTagToken:
+		if tag == r.holding {
+			r.holdDepth++
+		}
+	case html.EndTagToken:
+		if tag == r.holding {
+			r.holdDepth--
+		}
+	}
+	if r.holdDepth > 0 {
+		if len(r.held) > MaxHoldBytes {
+			// too big to check, let it thru
+			r.out = append(r.out, r.held...)
+			r.held, r.holding, r.holdFilters = nil, "", nil
+			r.heldText.Reset()
+		}
+		return false
+	}
+	// the end of the element, now we know whether it goes
+	r.held = append(r.held, raw...)
+	text := r.heldText.String()
+	remove := false
+	for _, f := range r.holdFilters {
+		if f.MatchesText(text) {
+			remove = true
+		}
+	}
+	if remove {
+		r.removed++
+	} else {
+		r.out = append(r.out, r.held...)
+	}
+	r.held, r.holding, r.holdFilters = nil, "", nil
+	r.heldText.Reset()
+	return true
+}
+
+func (r *Reader) startTag(tokenType html.TokenType, tag string, hasAttr bool, raw []byte) {
+	filters := r.elementFilters[tag]
+	if len(filters) == 0 && len(r.attrFilters) == 0 {
+		r.emit(raw)
+		return
+	}
+	var attrs []html.Attribute
+	for more := hasAttr; more; {
+		var key, val []byte
+		key, val, more = r.tokenizer.TagAttr()
+		attrs = append(attrs, html.Attribute{Key: string(key), Val: string(val)})
+	}
+	var needText []*rules.HtmlFilterRule
+	for _, f := range filters {
+		switch {
+		case len(f.HasText) > 0:
+			needText = append(needText, f)
+			continue
+		case f.BlockedSrc:
+			if src := attrValue(attrs, "src"); len(src) == 0 || r.isBlocked == nil || !r.isBlocked(src) {
+				continue
+			}
+		}
+		r.removed++
+		if tokenType == html.StartTagToken && !voidElements[tag] {
+			r.removing, r.removingDepth = tag, 1
+		}
+		return
+	}
+	out := raw
+	if kept := r.stripAttrs(attrs); len(kept) < len(attrs) {
+		t := html.Token{Type: tokenType, Data: tag, Attr: kept}
+		out = []byte(t.String())
+	}
+	if len(needText) > 0 && len(r.holding) == 0 && tokenType == html.StartTagToken && !voidElements[tag] {
+		r.holding, r.holdDepth, r.holdFilters = tag, 1, needText
+		r.held = append(r.held, out...)
+		return
+	}
+	r.emit(out)
+}
+
+// The attributes no filter strips
+func (r *Reader) stripAttrs(attrs []html.Attribute) []html.Attribute {
+	if len(r.attrFilters) == 0 {
+		return attrs
+	}
+	kept := make([]html.Attribute, 0, len(attrs))
+	for _, a := range attrs {
+		strip := false
+		for _, f := range r.attrFilters {
+			if f.StripsAttr(a.Key) {
+				strip = true
+			}
+		}
+		if strip {
+			r.removed++
+		} else {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+func attrValue(attrs []html.Attribute, key string) string {
+	for _, a := range attrs {
+		if a.Key == key {
+			return strings.TrimSpace(a.Val)
+		}
+	}
+	return ""
+}
+
+// Pass along b, or hold on to it with the element it's in
+func (r *Reader) emit(b []byte) {
+	if len(r.holding) > 0 {
+		r.held = append(r.held, b...)
+	} else {
+		r.out = append(r.out, b...)
+	}
+}
@@ -0,0 +1,145 @@
+package htmlfilter
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/jcuga/proxyblock/proxy/rules"
+)
+
+func filter(t *testing.T, page string, lines ...string) (string, int) {
+	t.Helper()
+	var filters []*rules.HtmlFilterRule
+	for _, line := range lines {
+		f, err := rules.ParseHtmlFilterRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filters = append(filters, f)
+	}
+	isBlocked := func(src string) bool {
+		return strings.Contains(src, "ads.example.com")
+	}
+	var removed int
+	r := NewReader(ioutil.NopCloser(strings.NewReader(page)), ForSite(filters, "example.com"), isBlocked,
+		func(n int, err error) {
+			if err != nil {
+				t.Errorf("finished with %v", err)
+			}
+			removed = n
+		})
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), removed
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		name        string
+		filters     []string
+		page        string
+		want        string
+		wantRemoved int
+	}{
+		{
+			"nothing to filter",
+			[]string{"##^noscript"},
+			`<html><body><p class="a">Hi &amp; bye</p></body></html>`,
+			`<html><body><p class="a">Hi &amp; bye</p></body></html>`,
+			0,
+		},
+		{
+			"element with what's inside it",
+			[]string{"##^aside"},
+			`<body><aside><img src="/p.gif"><aside>x</aside></aside><p>kept</p></body>`,
+			`<body><p>kept</p></body>`,
+			1,
+		},
+		{
+			"unclosed element stops at the body",
+			[]string{"##^aside"},
+			`<body><aside><p>x</body></html>`,
+			`<body></body></html>`,
+			1,
+		},
+		{
+			"raw text element",
+			[]string{"##^noscript"},
+			`<noscript><img src="/p.gif"></noscript><p>kept</p>`,
+			`<p>kept</p>`,
+			1,
+		},
+		{
+			"blocked src",
+			[]string{"##^iframe:blocked-src"},
+			`<iframe src="https://ads.example.com/f"></iframe><iframe src="/ok"></iframe>`,
+			`<iframe src="/ok"></iframe>`,
+			1,
+		},
+		{
+			"attributes",
+			[]string{"##^[on*]", "##^[ping]"},
+			`<a href="/x" onclick="track()" ping="/p" OnMouseOver="x()">x</a>`,
+			`<a href="/x">x</a>`,
+			3,
+		},
+		{
+			"has-text",
+			[]string{"##^script:has-text(adsbygoogle)"},
+			`<script>var a = 1;</script><script>(adsbygoogle = []).push({});</script>`,
+			`<script>var a = 1;</script>`,
+			1,
+		},
+		{
+			"has-text regexp",
+			[]string{`##^script:has-text(/fbq\(['"]init/)`},
+			`<script>fbq('init', '1');</script><script>fbq.x</script>`,
+			`<script>fbq.x</script>`,
+			1,
+		},
+		{
+			"has-text nested",
+			[]string{"##^div:has-text(Sponsored)"},
+			`<div><div><p>Sponsored</p></div></div><div><div>News</div></div>`,
+			`<div><div>News</div></div>`,
+			1,
+		},
+		{
+			"filters inside a has-text candidate",
+			[]string{"##^div:has-text(Sponsored)", "##^[on*]", "##^iframe"},
+			`<div><a href="/x" onclick="track()">News</a><iframe src="/f"></iframe></div>`,
+			`<div><a href="/x">News</a></div>`,
+			2,
+		},
+		{
+			"other sites",
+			[]string{"other.com##^noscript", "##^script", "example.com#@#^script"},
+			`<noscript>x</noscript><script>y</script>`,
+			`<noscript>x</noscript><script>y</script>`,
+			0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, removed := filter(t, test.page, test.filters...)
+			if got != test.want {
+				t.Errorf("got  %s\nwant %s", got, test.want)
+			}
+			if removed != test.wantRemoved {
+				t.Errorf("removed %d, want %d", removed, test.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestReaderLetsBigElementsThru(t *testing.T) {
+	defer func(max int) { MaxHoldBytes = max }(MaxHoldBytes)
+	MaxHoldBytes = 16
+	page := `<div><p>Sponsored</p><p>` + strings.Repeat("x", 32) + `</p></div>`
+	if got, _ := filter(t, page, "##^div:has-text(Sponsored)"); got != page {
+		t.Errorf("got %s, want the page as-is", got)
+	}
+}
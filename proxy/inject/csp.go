@@ -0,0 +1,184 @@
+package inject
+
+// Pages with a Content-Security-Policy won't run our inline script or load our
+// iframe from the control server.  CSPPatch loosens a page's policies just
+// enough for the injection: a per-response nonce is allowed for scripts and
+// styles, and the control server is allowed as a frame source.  Everything
+// else about the page's policy is left as-is.
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrCSPSandbox = errors.New("Content-Security-Policy sandbox doesn't allow scripts")
+
+	cspHeaders = []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"}
+)
+
+type CSPPatch struct {
+	// Goes in the nonce attribute of the injected <script> and <style>
+	Nonce string
+	// Where the injected iframe is loaded from, ie http://127.0.0.1:8380
+	FrameOrigin string
+}
+
+// A patch with a fresh nonce, use one per response
+func NewCSPPatch(frameOrigin string) *CSPPatch {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return &CSPPatch{Nonce: base64.StdEncoding.EncodeToString(b), FrameOrigin: frameOrigin}
+}
+
+// Rewrite the Content-Security-Policy headers in h.  Returns ErrCSPSandbox if
+// the page's policy keeps scripts from running at all.
+func (p *CSPPatch) RewriteHeaders(h http.Header) error {
+	for _, name := range cspHeaders {
+		values := h[name]
+		for i, v := range values {
+			if name == "Content-Security-Policy" && sandboxesScripts(v) {
+				return ErrCSPSandbox
+			}
+			values[i] = p.Rewrite(v)
+		}
+	}
+	return nil
+}
+
+// Rewrite a header value (or <meta> content) holding one or more policies
+func (p *CSPPatch) Rewrite(value string) string {
+	policies := strings.Split(value, ",")
+	for i, policy := range policies {
+		policies[i] = p.rewritePolicy(policy)
+	}
+	return strings.Join(policies, ", ")
+}
+
+func (p *CSPPatch) rewritePolicy(policy string) string {
+	directives := parsePolicy(policy)
+	nonce := "'nonce-" + p.Nonce + "'"
+	for _, names := range [][]string{
+		{"script-src", "default-src"},
+		{"style-src", "default-src"},
+		// these take precedence for <script> and <style>, if the page has them
+		{"script-src-elem"},
+		{"style-src-elem"},
+	} {
+		directives = allowInline(directives, names, nonce)
+	}
+	directives = allowSource(directives, []string{"frame-src", "child-src", "default-src"}, p.FrameOrigin)
+	parts := make([]string, 0, len(directives))
+	for _, d := range directives {
+		parts = append(parts, strings.Join(append([]string{d.name}, d.sources...), " "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+type directive struct {
+	name    string
+	sources []string
+}
+
+func parsePolicy(policy string) []directive {
+	var directives []directive
+	for _, part := range strings.Split(policy, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		directives = append(directives, directive{strings.ToLower(fields[0]), fields[1:]})
+	}
+	return directives
+}
+
+// The directive that applies, ie the first of names the policy has.  Returns
+// -1 if none of them are there (so anything goes).  Only the first occurrence
+// of a directive counts, same as browsers.
+func effective(directives []directive, names []string) int {
+	for _, name := range names {
+		for i, d := range directives {
+			if d.name == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Make sure the directive names[0] (or whatever it falls back to) allows
+// source.  If it currently falls back to something else, names[0] is added
+// with a copy of the fallback's sources.
+func allowSource(directives []directive, names []string, source string) []directive {
+	i := effective(directives, names)
+	if i < 0 {
+		return directives
+	}
+	if directives[i].name != names[0] {
+		directives = append(directives, directive{names[0], append([]string(nil), directives[i].sources...)})
+		i = len(directives) - 1
+	}
+	d := &directives[i]
+	kept := d.sources[:0]
+	for _, s := range d.sources {
+		if strings.EqualFold(s, source) {
+			return directives
+		}
+		// 'none' can't be combined with any other source
+		if !strings.EqualFold(s, "'none'") {
+			kept = append(kept, s)
+		}
+	}
+	d.sources = append(kept, source)
+	return directives
+}
+
+// Like allowSource for the injection's nonce, unless inline is already
+// allowed: adding a nonce to a list with 'unsafe-inline' would turn off
+// 'unsafe-inline' and break the page's own inline scripts.
+func allowInline(directives []directive, names []string, nonce string) []directive {
+	i := effective(directives, names)
+	if i < 0 {
+		return directives
+	}
+	unsafeInline, nonceOrHash := false, false
+	for _, s := range directives[i].sources {
+		s = strings.ToLower(s)
+		switch {
+		case s == "'unsafe-inline'":
+			unsafeInline = true
+		case s == "'strict-dynamic'", strings.HasPrefix(s, "'nonce-"), strings.HasPrefix(s, "'sha"):
+			nonceOrHash = true
+		}
+	}
+	if unsafeInline && !nonceOrHash {
+		return directives
+	}
+	return allowSource(directives, names, nonce)
+}
+
+// Whether the policy has a sandbox directive without allow-scripts
+func sandboxesScripts(value string) bool {
+	for _, policy := range strings.Split(value, ",") {
+		for _, d := range parsePolicy(policy) {
+			if d.name != "sandbox" {
+				continue
+			}
+			allowed := false
+			for _, s := range d.sources {
+				if strings.EqualFold(s, "allow-scripts") {
+					allowed = true
+				}
+			}
+			if !allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
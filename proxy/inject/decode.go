@@ -0,0 +1,153 @@
+package inject
+
+// Gets response bodies into a form the injector can work with: compressed
+// bodies are decompressed (and served to the browser uncompressed), and pages
+// in charsets that aren't ASCII compatible (UTF-16 and friends) are converted
+// to UTF-8.  Pages in ASCII compatible charsets (UTF-8, ISO-8859-*,
+// windows-125*, Shift_JIS, GBK, ...) are left byte for byte as-is since our
+// injection is plain ASCII.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// How much of the body is looked at to determine its charset when the
+// Content-Type header doesn't say
+const charsetSniffBytes = 1024
+
+// Decompress resp's body according to its Content-Encoding and drop the
+// Content-Encoding (and Content-Length) headers to match.  Returns an error,
+// leaving resp as it was, if the encoding isn't one we can decode or the body
+// doesn't start out the way its encoding says it should.
+func DecodeBody(resp *http.Response) error {
+	var encodings []string
+	for _, e := range strings.Split(resp.Header.Get("Content-Encoding"), ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch e {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip", "deflate", "br":
+			encodings = append(encodings, e)
+		default:
+			return fmt.Errorf("unsupported Content-Encoding: %q", e)
+		}
+	}
+	if len(encodings) == 0 {
+		return nil
+	}
+	// Setting up the decoders reads (gzip headers and such) from the body,
+	// keep those bytes in case it has to be put back.
+	rec := &setupRecorder{src: resp.Body}
+	var body io.Reader = rec
+	// encodings are listed in the order they were applied, undo in reverse
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err error
+		if body, err = decoderFor(encodings[i], body); err != nil {
+			resp.Body = &wrappedBody{io.NopCloser(io.MultiReader(bytes.NewReader(rec.buf), resp.Body)), resp.Body}
+			return fmt.Errorf("bad %s body: %v", encodings[i], err)
+		}
+	}
+	rec.done, rec.buf = true, nil
+	resp.Body = &wrappedBody{io.NopCloser(body), resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+func decoderFor(encoding string, body io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		// Supposed to be zlib wrapped, but some servers send raw deflate.
+		buffered := bufio.NewReader(body)
+		if header, err := buffered.Peek(2); err == nil && isZlibHeader(header) {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	case "br":
+		return brotli.NewReader(body), nil
+	}
+	return nil, fmt.Errorf("unsupported Content-Encoding: %q", encoding)
+}
+
+// Keeps a copy of what's read thru it until done, so a body can be put back
+// together if its decoders can't be set up
+type setupRecorder struct {
+	src  io.Reader
+	buf  []byte
+	done bool
+}
+
+func (rec *setupRecorder) Read(p []byte) (int, error) {
+	n, err := rec.src.Read(p)
+	if !rec.done {
+		rec.buf = append(rec.buf, p[:n]...)
+	}
+	return n, err
+}
+
+func isZlibHeader(header []byte) bool {
+	return header[0]&0x0F == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// Make sure resp's body is in an ASCII compatible charset, converting it to
+// UTF-8 (and updating the Content-Type header) if it isn't.
+func NormalizeCharset(resp *http.Response) error {
+	buffered := bufio.NewReaderSize(resp.Body, charsetSniffBytes)
+	// Peek returns an error (that we don't care about) for short bodies
+	start, _ := buffered.Peek(charsetSniffBytes)
+	contentType := resp.Header.Get("Content-Type")
+	enc, name, _ := charset.DetermineEncoding(start, contentType)
+	if isAsciiCompatible(enc) {
+		resp.Body = &wrappedBody{io.NopCloser(buffered), resp.Body}
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("can't convert %s page, bad Content-Type: %v", name, err)
+	}
+	params["charset"] = "utf-8"
+	resp.Header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Body = &wrappedBody{io.NopCloser(transform.NewReader(buffered, enc.NewDecoder())), resp.Body}
+	return nil
+}
+
+// Whether ASCII text (like our html/javascript) encodes to the same bytes
+func isAsciiCompatible(enc encoding.Encoding) bool {
+	const sample = "<body class=\"x\">\n<script>var a = 'b';</script>"
+	encoded, err := enc.NewEncoder().Bytes([]byte(sample))
+	return err == nil && bytes.Equal(encoded, []byte(sample))
+}
+
+// A replacement body that also closes the original body
+type wrappedBody struct {
+	io.ReadCloser
+	orig io.ReadCloser
+}
+
+func (w *wrappedBody) Close() error {
+	err := w.ReadCloser.Close()
+	if origErr := w.orig.Close(); err == nil {
+		err = origErr
+	}
+	return err
+}
@@ -0,0 +1,191 @@
+package inject
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func newFixtureResponse(body []byte, contentType, contentEncoding string) *http.Response {
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Length", "1")
+	if len(contentEncoding) > 0 {
+		resp.Header.Set("Content-Encoding", contentEncoding)
+	}
+	return resp
+}
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "raw deflate":
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			t.Fatal(err)
+		}
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown encoding %q", encoding)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readBody(t *testing.T, resp *http.Response) []byte {
+	t.Helper()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestDecodeBody(t *testing.T) {
+	page := readFixture(t, "page.html")
+	tests := []struct {
+		name            string
+		contentEncoding string
+		body            []byte
+	}{
+		{"identity", "", page},
+		{"gzip", "gzip", compress(t, "gzip", page)},
+		{"x-gzip", "x-gzip", compress(t, "gzip", page)},
+		{"deflate zlib", "deflate", compress(t, "zlib", page)},
+		{"deflate raw", "deflate", compress(t, "raw deflate", page)},
+		{"br", "br", compress(t, "br", page)},
+		{"gzip then br", "gzip, br", compress(t, "br", compress(t, "gzip", page))},
+		{"upper case", "GZIP", compress(t, "gzip", page)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := newFixtureResponse(test.body, "text/html", test.contentEncoding)
+			if err := DecodeBody(resp); err != nil {
+				t.Fatalf("DecodeBody: %v", err)
+			}
+			if got := readBody(t, resp); !bytes.Equal(got, page) {
+				t.Errorf("body = %q, want %q", got, page)
+			}
+			if len(test.contentEncoding) == 0 {
+				return
+			}
+			if ce := resp.Header.Get("Content-Encoding"); len(ce) > 0 {
+				t.Errorf("Content-Encoding = %q, want it removed", ce)
+			}
+			if cl := resp.Header.Get("Content-Length"); len(cl) > 0 || resp.ContentLength != -1 {
+				t.Errorf("Content-Length = %q (%d), want it removed", cl, resp.ContentLength)
+			}
+		})
+	}
+}
+
+// Bodies that can't be decoded have to reach the browser exactly as they came
+func TestDecodeBodyLeavesUndecodableBodies(t *testing.T) {
+	page := readFixture(t, "page.html")
+	gzipped := compress(t, "gzip", page)
+	tests := []struct {
+		name            string
+		contentEncoding string
+		body            []byte
+	}{
+		{"unsupported outer encoding", "zstd, gzip", gzipped},
+		{"unsupported inner encoding", "gzip, zstd", gzipped},
+		{"not actually gzip", "gzip", page},
+		{"not actually gzip inside br", "gzip, br", compress(t, "br", page)},
+		{"truncated gzip header", "gzip", gzipped[:4]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := newFixtureResponse(test.body, "text/html", test.contentEncoding)
+			if err := DecodeBody(resp); err == nil {
+				t.Fatal("DecodeBody didn't fail")
+			}
+			if got := readBody(t, resp); !bytes.Equal(got, test.body) {
+				t.Errorf("body = %q, want it untouched: %q", got, test.body)
+			}
+			if ce := resp.Header.Get("Content-Encoding"); ce != test.contentEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", ce, test.contentEncoding)
+			}
+		})
+	}
+}
+
+func TestNormalizeCharset(t *testing.T) {
+	tests := []struct {
+		fixture     string
+		contentType string
+		// empty if the page should pass thru untouched
+		wantUtf8    string
+		wantCharset string
+	}{
+		{"page.html", "text/html", "", ""},
+		{"latin1.html", "text/html; charset=iso-8859-1", "", "iso-8859-1"},
+		// charset only in the <meta> tag
+		{"latin1.html", "text/html", "", ""},
+		{"shift_jis.html", "text/html; charset=Shift_JIS", "", "Shift_JIS"},
+		{"shift_jis.html", "text/html", "", ""},
+		{"utf16.html", "text/html; charset=utf-16", "<p>Wide page é</p>", "utf-8"},
+		// byte order mark only
+		{"utf16.html", "text/html", "<p>Wide page é</p>", "utf-8"},
+	}
+	for _, test := range tests {
+		t.Run(test.fixture+" "+test.contentType, func(t *testing.T) {
+			fixture := readFixture(t, test.fixture)
+			resp := newFixtureResponse(fixture, test.contentType, "")
+			if err := NormalizeCharset(resp); err != nil {
+				t.Fatalf("NormalizeCharset: %v", err)
+			}
+			got := readBody(t, resp)
+			if len(test.wantUtf8) == 0 {
+				if !bytes.Equal(got, fixture) {
+					t.Errorf("body = %q, want it byte for byte: %q", got, fixture)
+				}
+			} else if !strings.Contains(string(got), test.wantUtf8) {
+				t.Errorf("body = %q, want it to contain %q", got, test.wantUtf8)
+			}
+			_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			if params["charset"] != test.wantCharset {
+				t.Errorf("Content-Type = %q, want charset %q", resp.Header.Get("Content-Type"), test.wantCharset)
+			}
+		})
+	}
+}
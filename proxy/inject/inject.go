@@ -0,0 +1,359 @@
+package inject
+
+// Streams html responses thru while inserting our page controls at the start
+// of the page's body.  The page is run thru an html tokenizer so that a
+// "<body" inside a comment, script or attribute isn't mistaken for the real
+// thing.  Pages without an explicit <body> tag get the controls where the
+// browser would start the body: after </head> and any head content, right
+// before the first bit of actual page content.  Responses that don't look like
+// a whole document (fragments fetched by scripts) are left alone.
+//
+// Only the part of the page up to the insertion point is held in memory.  Once
+// the controls are injected (or we've given up) the rest of the page is passed
+// thru untouched.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	// Give up looking for the start of the body after this much of the page
+	MaxSearchBytes = 1 << 20
+	// Pass along what's been scanned once this much has piled up
+	flushBytes = 32 << 10
+
+	// Reasons a page didn't get the injection
+	ErrNotDocument  = errors.New("not an html document")
+	ErrFrameset     = errors.New("frameset page")
+	ErrBodyNotFound = fmt.Errorf("no start of body found in first %d bytes", MaxSearchBytes)
+)
+
+// Elements that belong in (or before) <head>.  Anything else means the body
+// has started.
+var headElements = map[atom.Atom]bool{
+	atom.Html:     true,
+	atom.Head:     true,
+	atom.Base:     true,
+	atom.Basefont: true,
+	atom.Bgsound:  true,
+	atom.Link:     true,
+	atom.Meta:     true,
+	atom.Noframes: true,
+	atom.Noscript: true,
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Template: true,
+	atom.Title:    true,
+}
+
+// Head elements whose contents come thru as text
+var textElements = map[atom.Atom]bool{
+	atom.Noframes: true,
+	atom.Noscript: true,
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Title:    true,
+}
+
+type Reader struct {
+	src       io.ReadCloser
+	injection []byte
+	tokenizer *html.Tokenizer
+	// Everything the tokenizer has read from src that hasn't gone to out yet
+	rec *recorder
+	// How much of rec.buf the tokenizer is done with
+	scanned int
+	// Total bytes of the page scanned so far
+	searched int
+	// Seen a doctype, <html>, <head>, <title> or <body>
+	isDocument bool
+	// Inside a <title>, <script>, etc (whose text isn't page content)
+	inTextElement atom.Atom
+	// Nesting depth of <template>s, whose content isn't page content either
+	templateDepth int
+	// Ready to be returned by Read
+	out []byte
+	// Injected or gave up, pass the rest thru
+	done     bool
+	injected bool
+	// Rewrites <meta> Content-Security-Policy tags, if set
+	csp *CSPPatch
+	// Replacement for the current token
+	rewritten []byte
+	// Called once injected (nil) or given up (why)
+	finished func(err error)
+}
+
+// Wrap an html body so that injection gets inserted at the start of the
+// page's body.  If csp is given, policies set by <meta> tags are loosened to
+// let the injection run.  finished, if given, is called with nil once the
+// injection is in, or with the reason it won't be.
+func NewReader(src io.ReadCloser, injection string, csp *CSPPatch, finished func(err error)) *Reader {
+	rec := &recorder{src: src}
+	tokenizer := html.NewTokenizer(rec)
+	tokenizer.SetMaxBuf(MaxSearchBytes)
+	return &Reader{
+		src:       src,
+		injection: []byte(injection),
+		tokenizer: tokenizer,
+		rec:       rec,
+		csp:       csp,
+		finished:  finished,
+	}
+}
+
+// Whether the injection has been written (so far)
+func (r *Reader) Injected() bool {
+	return r.injected
+}
+
+// Whether req is for something the browser will show as a page (as opposed to
+// something fetched by a script or for a page).  Pages in frames count unless
+// topLevelOnly.  Older browsers that don't send Sec-Fetch-Dest are judged by
+// whether they ask for html.
+func IsDocumentRequest(req *http.Request, topLevelOnly bool) bool {
+	if req.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return false
+	}
+	switch req.Header.Get("Sec-Fetch-Dest") {
+	case "document":
+		return true
+	case "iframe", "frame", "nested-document":
+		return !topLevelOnly
+	case "":
+		return strings.Contains(req.Header.Get("Accept"), "text/html")
+	}
+	return false
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			if len(r.rec.buf) > 0 {
+				// read by the tokenizer but not passed along yet
+				r.out, r.rec.buf = r.rec.buf, nil
+				continue
+			}
+			if r.rec.err != nil {
+				return 0, r.rec.err
+			}
+			// nothing held back anymore, read straight thru
+			return r.src.Read(p)
+		}
+		r.step()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// Look at the next token and decide whether it's where the injection goes.
+func (r *Reader) step() {
+	tokenType := r.tokenizer.Next()
+	if tokenType == html.ErrorToken {
+		switch err := r.tokenizer.Err(); {
+		case err == io.EOF && !r.isDocument:
+			r.giveUp(ErrNotDocument)
+		case err == io.EOF && r.inTextElement != 0:
+			r.giveUp(fmt.Errorf("page ended inside <%s>", r.inTextElement))
+		case err == io.EOF:
+			// Nothing but head content, the body would start at the end
+			r.injectAt(r.scanned)
+		case err == html.ErrBufferExceeded:
+			r.giveUp(ErrBodyNotFound)
+		default:
+			// error reading the page, pass along what we got and the error
+			r.giveUp(fmt.Errorf("error reading page: %v", err))
+		}
+		return
+	}
+	start := r.scanned
+	r.scanned += len(r.tokenizer.Raw())
+	r.searched += r.scanned - start
+
+	where, err := r.bodyStart(tokenType)
+	if r.rewritten != nil {
+		buf := make([]byte, 0, len(r.rec.buf)-(r.scanned-start)+len(r.rewritten))
+		buf = append(buf, r.rec.buf[:start]...)
+		buf = append(buf, r.rewritten...)
+		r.rec.buf = append(buf, r.rec.buf[r.scanned:]...)
+		r.scanned = start + len(r.rewritten)
+		r.rewritten = nil
+	}
+	switch where {
+	case beforeToken:
+		r.injectAt(start)
+		return
+	case afterToken:
+		r.injectAt(r.scanned)
+		return
+	case noBody:
+		r.giveUp(err)
+		return
+	}
+	if r.searched > MaxSearchBytes {
+		r.giveUp(ErrBodyNotFound)
+		return
+	}
+	// Pass along what's been scanned when the tokenizer is about to wait on
+	// more of the page, or enough has piled up.
+	if r.scanned == len(r.rec.buf) || r.scanned >= flushBytes {
+		r.out = append(r.out, r.rec.buf[:r.scanned]...)
+		r.rec.buf = append([]byte(nil), r.rec.buf[r.scanned:]...)
+		r.scanned = 0
+	}
+}
+
+type bodyStart int
+
+const (
+	notYet bodyStart = iota
+	beforeToken
+	afterToken
+	noBody
+)
+
+// Whether the current token is where the page's body starts, and if there
+// isn't going to be one, why.
+func (r *Reader) bodyStart(tokenType html.TokenType) (bodyStart, error) {
+	switch tokenType {
+	case html.DoctypeToken:
+		r.isDocument = true
+		return notYet, nil
+	case html.CommentToken:
+		return notYet, nil
+	case html.TextToken:
+		if r.inTextElement != 0 || r.templateDepth > 0 ||
+			len(bytes.Trim(r.tokenizer.Raw(), " \t\r\n\f\ufeff")) == 0 {
+			return notYet, nil
+		}
+	case html.StartTagToken, html.SelfClosingTagToken:
+		name, hasAttr := r.tokenizer.TagName()
+		tag := atom.Lookup(name)
+		if r.templateDepth > 0 {
+			if tag == atom.Template && tokenType == html.StartTagToken {
+				r.templateDepth++
+			}
+			return notYet, nil
+		}
+		if tag == atom.Meta && hasAttr && r.csp != nil {
+			r.rewriteMetaCSP(tokenType)
+		}
+		if textElements[tag] && tokenType == html.StartTagToken {
+			r.inTextElement = tag
+		}
+		switch tag {
+		case atom.Template:
+			if tokenType == html.StartTagToken {
+				r.templateDepth++
+			}
+		case atom.Body:
+			r.isDocument = true
+			return afterToken, nil
+		case atom.Frameset:
+			// no body to put anything in
+			return noBody, ErrFrameset
+		case atom.Html, atom.Head, atom.Title:
+			r.isDocument = true
+		}
+		if headElements[tag] {
+			return notYet, nil
+		}
+	case html.EndTagToken:
+		name, _ := r.tokenizer.TagName()
+		tag := atom.Lookup(name)
+		if tag == r.inTextElement {
+			r.inTextElement = 0
+		}
+		if tag == atom.Template && r.templateDepth > 0 {
+			r.templateDepth--
+			return notYet, nil
+		}
+		if r.templateDepth > 0 {
+			return notYet, nil
+		}
+		if tag != atom.Body && tag != atom.Html && headElements[tag] {
+			return notYet, nil
+		}
+	}
+	// Actual page content
+	if !r.isDocument {
+		return noBody, ErrNotDocument
+	}
+	return beforeToken, nil
+}
+
+// Loosen the policy of a <meta http-equiv="Content-Security-Policy"> tag
+func (r *Reader) rewriteMetaCSP(tokenType html.TokenType) {
+	var attrs []html.Attribute
+	isCSP := false
+	for more := true; more; {
+		var key, val []byte
+		key, val, more = r.tokenizer.TagAttr()
+		attrs = append(attrs, html.Attribute{Key: string(key), Val: string(val)})
+		if string(key) == "http-equiv" && strings.EqualFold(strings.TrimSpace(string(val)), "content-security-policy") {
+			isCSP = true
+		}
+	}
+	if !isCSP {
+		return
+	}
+	for i := range attrs {
+		if attrs[i].Key == "content" {
+			attrs[i].Val = r.csp.Rewrite(attrs[i].Val)
+		}
+	}
+	tag := html.Token{Type: tokenType, Data: "meta", Attr: attrs}
+	r.rewritten = []byte(tag.String())
+}
+
+func (r *Reader) injectAt(i int) {
+	out := make([]byte, 0, len(r.rec.buf)+len(r.injection))
+	out = append(out, r.rec.buf[:i]...)
+	out = append(out, r.injection...)
+	out = append(out, r.rec.buf[i:]...)
+	r.out = append(r.out, out...)
+	r.rec.buf = nil
+	r.done = true
+	r.injected = true
+	if r.finished != nil {
+		r.finished(nil)
+	}
+}
+
+func (r *Reader) giveUp(why error) {
+	r.out = append(r.out, r.rec.buf...)
+	r.rec.buf = nil
+	r.done = true
+	if r.finished != nil {
+		r.finished(why)
+	}
+}
+
+func (r *Reader) Close() error {
+	return r.src.Close()
+}
+
+// Keeps a copy of everything read from src, and the error that ended it
+type recorder struct {
+	src io.Reader
+	buf []byte
+	err error
+}
+
+func (rec *recorder) Read(p []byte) (int, error) {
+	n, err := rec.src.Read(p)
+	rec.buf = append(rec.buf, p[:n]...)
+	if err != nil {
+		rec.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,70 @@
+package inject
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+var bodyTag = regexp.MustCompile(`(?i)<body[^>]*>`)
+
+// Pages that aren't UTF-8 get the injection in the right spot, with the rest
+// of the page left alone
+func TestInjectFixtures(t *testing.T) {
+	const injection = "<script>injected()</script>"
+	for _, fixture := range []string{"page.html", "latin1.html", "shift_jis.html"} {
+		t.Run(fixture, func(t *testing.T) {
+			page := readFixture(t, fixture)
+			var finishedErr error
+			r := NewReader(ioutil.NopCloser(bytes.NewReader(page)), injection, nil, func(err error) {
+				finishedErr = err
+			})
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if finishedErr != nil {
+				t.Fatalf("injection failed: %v", finishedErr)
+			}
+			end := bodyTag.FindIndex(page)[1]
+			want := append(append(append([]byte(nil), page[:end]...), injection...), page[end:]...)
+			if !bytes.Equal(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestIsDocumentRequest(t *testing.T) {
+	const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		wantDocument bool
+		wantTopLevel bool
+	}{
+		{"page", map[string]string{"Sec-Fetch-Dest": "document", "Accept": browserAccept}, true, true},
+		{"iframe", map[string]string{"Sec-Fetch-Dest": "iframe", "Accept": browserAccept}, true, false},
+		{"frame", map[string]string{"Sec-Fetch-Dest": "frame"}, true, false},
+		{"script", map[string]string{"Sec-Fetch-Dest": "script", "Accept": "*/*"}, false, false},
+		{"fetch for html", map[string]string{"Sec-Fetch-Dest": "empty", "Accept": "text/html"}, false, false},
+		{"xhr", map[string]string{"X-Requested-With": "XMLHttpRequest", "Accept": browserAccept}, false, false},
+		{"older browser page", map[string]string{"Accept": browserAccept}, true, true},
+		{"older browser image", map[string]string{"Accept": "image/webp,*/*"}, false, false},
+		{"no headers", map[string]string{}, false, false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		if got := IsDocumentRequest(req, false); got != test.wantDocument {
+			t.Errorf("%s: IsDocumentRequest(req, false) = %v, want %v", test.name, got, test.wantDocument)
+		}
+		if got := IsDocumentRequest(req, true); got != test.wantTopLevel {
+			t.Errorf("%s: IsDocumentRequest(req, true) = %v, want %v", test.name, got, test.wantTopLevel)
+		}
+	}
+}
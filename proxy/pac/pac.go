@@ -0,0 +1,109 @@
+package pac
+
+// Generates a proxy auto-config file so browsers/OSes can be pointed at
+// http://127.0.0.1:<control port>/proxy.pac instead of being configured by
+// hand.  It can also be served on an address of its own, so other machines
+// can use it or discover it via WPAD (http://wpad/wpad.dat).  Local traffic
+// always goes direct, everything else goes thru proxyblock.  Optionally, hosts
+// whitelisted by ||host rules go direct too, skipping the proxy (and the page
+// controls) entirely.
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"text/template"
+)
+
+const (
+	PacUrl  = "/proxy.pac"
+	WpadUrl = "/wpad.dat"
+)
+
+var pacTemplate = template.Must(template.New("pac").Parse(`// Generated by proxyblock
+function FindProxyForURL(url, host) {
+    host = host.toLowerCase();
+    // local traffic goes direct
+    if (isPlainHostName(host) || host == "localhost" || dnsDomainIs(host, ".local")) {
+        return "DIRECT";
+    }
+    if (/^[0-9.]+$/.test(host) && (isInNet(host, "127.0.0.0", "255.0.0.0") ||
+            isInNet(host, "10.0.0.0", "255.0.0.0") ||
+            isInNet(host, "172.16.0.0", "255.240.0.0") ||
+            isInNet(host, "192.168.0.0", "255.255.0.0") ||
+            isInNet(host, "169.254.0.0", "255.255.0.0"))) {
+        return "DIRECT";
+    }
+    if (host == "::1" || host == "[::1]") {
+        return "DIRECT";
+    }
+{{- if .DirectHosts}}
+    // whitelisted hosts skip the proxy
+    var directHosts = [{{range $i, $h := .DirectHosts}}{{if $i}}, {{end}}"{{js $h}}"{{end}}];
+    for (var i = 0; i < directHosts.length; i++) {
+        if (host == directHosts[i] || dnsDomainIs(host, "." + directHosts[i])) {
+            return "DIRECT";
+        }
+    }
+{{- end}}
+    return "PROXY {{js .ProxyAddr}}";
+}
+`))
+
+type pacData struct {
+	ProxyAddr   string
+	DirectHosts []string
+}
+
+// Render a pac file sending traffic to proxyAddr (host:port) except for
+// local addresses and directHosts (and their subdomains).
+func Generate(proxyAddr string, directHosts []string) (string, error) {
+	var buf bytes.Buffer
+	if err := pacTemplate.Execute(&buf, pacData{proxyAddr, directHosts}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Serve the pac file on its own address in the background, at both PacUrl and
+// WpadUrl.  Nothing else from the control server is reachable there.
+func Serve(addr string, handler func(http.ResponseWriter, *http.Request)) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("ERROR: failed to start pac file server.  error: %q", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(PacUrl, handler)
+	mux.HandleFunc(WpadUrl, handler)
+	log.Printf("Serving pac file on: %s", addr)
+	go http.Serve(ln, mux)
+}
+
+// Serves the pac file.  The pac file is generated on every request so it
+// always reflects the current rules.  If the proxy listens on all interfaces,
+// clients are pointed at the host they fetched the pac file from.
+func GetPacHandler(listenAddr string, getDirectHosts func() []string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		proxyAddr := listenAddr
+		if host, port, err := net.SplitHostPort(listenAddr); err == nil {
+			if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+				requestHost, _, splitErr := net.SplitHostPort(r.Host)
+				if splitErr != nil {
+					requestHost = r.Host
+				}
+				proxyAddr = net.JoinHostPort(requestHost, port)
+			}
+		}
+		pac, err := Generate(proxyAddr, getDirectHosts())
+		if err != nil {
+			log.Printf("ERROR: failed to generate pac file.  error: %q", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Write([]byte(pac))
+	}
+}
@@ -0,0 +1,52 @@
+package pac
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	pac, err := Generate("127.0.0.1:3128", []string{"example.com", `bad"host`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`return "PROXY 127.0.0.1:3128";`,
+		`var directHosts = ["example.com", "bad\"host"];`,
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("pac file missing %s:\n%s", want, pac)
+		}
+	}
+
+	if pac, err = Generate("127.0.0.1:3128", nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(pac, "directHosts") {
+		t.Errorf("pac file without direct hosts has them anyway:\n%s", pac)
+	}
+}
+
+func TestPacHandlerProxyAddr(t *testing.T) {
+	tests := []struct {
+		listenAddr string
+		host       string
+		want       string
+	}{
+		{"127.0.0.1:3128", "127.0.0.1:8380", "PROXY 127.0.0.1:3128"},
+		{"0.0.0.0:3128", "192.168.1.5:8381", "PROXY 192.168.1.5:3128"},
+		{":3128", "wpad", "PROXY wpad:3128"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "http://"+test.host+WpadUrl, nil)
+		GetPacHandler(test.listenAddr, func() []string { return nil })(rec, req)
+		if ct := rec.Header().Get("Content-Type"); ct != "application/x-ns-proxy-autoconfig" {
+			t.Errorf("%s: Content-Type = %q", test.listenAddr, ct)
+		}
+		if !strings.Contains(rec.Body.String(), test.want) {
+			t.Errorf("%s fetched from %s: want %q in\n%s", test.listenAddr, test.host, test.want, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,560 @@
+// Page controls, shown in the iframe injected into proxied pages.  Expects
+// pageControlsConfig ({page, site, state, ...}) to be set by the page.
+
+// Start checking events from a few (10) seconds ago in case our iframe
+// didn't load right away due to other js on parent page being slow.
+// Note: using time as milliseconds since epoch instead of some string
+// timestamp like earlier which caused internationalization issues
+var sinceTime = (new Date(Date.now() - 10000)).getTime();
+
+var stats = {
+    blocked: 0,
+    allowed: 0,
+    manual: 0
+};
+
+function byId(id) {
+    return document.getElementById(id);
+}
+
+function setClass(elem, name, on) {
+    if (on) {
+        elem.classList.add(name);
+    } else {
+        elem.classList.remove(name);
+    }
+}
+
+// Make a tag with the given classes and children, strings become text (never
+// html, urls in here come from the page being proxied).
+function makeElem(tag, className, children) {
+    var elem = document.createElement(tag);
+    if (className) {
+        elem.className = className;
+    }
+    for (var i = 0; children && i < children.length; i++) {
+        var child = children[i];
+        elem.appendChild(typeof child === "string" ? document.createTextNode(child) : child);
+    }
+    return elem;
+}
+
+// Send a request to the control server with data form encoded (in the url for
+// GETs).  onSuccess gets the response parsed as JSON (null if it isn't),
+// onError gets the xhr and the same.
+function request(method, url, data, onSuccess, onError) {
+    var params = [];
+    for (var name in data) {
+        params.push(encodeURIComponent(name) + "=" + encodeURIComponent(data[name]));
+    }
+    var body = null;
+    if (params.length > 0 && method == "GET") {
+        url += (url.indexOf("?") < 0 ? "?" : "&") + params.join("&");
+    } else if (params.length > 0) {
+        body = params.join("&");
+    }
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, url);
+    xhr.setRequestHeader("Accept", "application/json");
+    xhr.setRequestHeader("X-Requested-With", "XMLHttpRequest");
+    if (body !== null) {
+        xhr.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+    }
+    xhr.onload = function () {
+        var response = null;
+        try {
+            response = JSON.parse(xhr.responseText);
+        } catch (e) {
+            // not JSON, leave it null
+        }
+        if (xhr.status >= 200 && xhr.status < 300) {
+            if (onSuccess) {
+                onSuccess(response);
+            }
+        } else if (onError) {
+            onError(xhr, response);
+        }
+    };
+    xhr.onerror = function () {
+        if (onError) {
+            onError(xhr, null);
+        }
+    };
+    xhr.send(body);
+}
+
+// How the user last left the controls on this site, the injected
+// wrapper in the parent page already starts out this way.
+var site = pageControlsConfig.site;
+var savedState = pageControlsConfig.state;
+var controlState = {
+    upTop: savedState.up_top,
+    expanded: savedState.expanded,
+    corner: savedState.corner,
+    collapsed: savedState.collapsed
+};
+
+function saveControlState() {
+    request("POST", "/control-state?site=" + encodeURIComponent(site), {
+        up_top: controlState.upTop,
+        expanded: controlState.expanded,
+        corner: controlState.corner,
+        collapsed: controlState.collapsed
+    });
+}
+
+// Buttons that only show while the controls are expanded
+var expandedItems = ["open-settings", "pick-element", "toggle-scripts"];
+
+function showExpandedItems(show) {
+    for (var i = 0; i < expandedItems.length; i++) {
+        setClass(byId(expandedItems[i]), "showme", show);
+    }
+}
+
+function showControlState() {
+    byId("toggle-details").textContent = controlState.expanded ? "_" : "+";
+    if (!controlState.expanded) {
+        showExpandedItems(false);
+    }
+    byId("move-controls").textContent = controlState.upTop ? "\u25BC" : "\u25B2";
+    byId("corner-controls").textContent = controlState.corner == "left" ? "\u25B6" : "\u25C0";
+    setClass(document.body, "collapsed", controlState.collapsed);
+}
+
+function toggleDetailsView(detailButton) {
+    controlState.expanded = !controlState.expanded;
+    showControlState();
+    if (controlState.expanded) {
+        setTimeout(function () {
+            showExpandedItems(true);
+        }, 200);
+    }
+    window.parent.postMessage({expanded: controlState.expanded}, "*");
+    saveControlState();
+}
+
+showControlState();
+if (controlState.expanded) {
+    showExpandedItems(true);
+}
+
+// for browsers that don't have console
+if(typeof window.console == 'undefined') { window.console = {log: function (msg) {} }; }
+
+(function poll() {
+    // the page's url, already without the proxy exception string so it
+    // matches our notification subscription category
+    var category = pageControlsConfig.page;
+    byId("info").textContent = category;
+    byId("info").setAttribute("alt", category);
+    var timeout = 15;  // in seconds
+    var optionalSince = "";
+    if (sinceTime) {
+        optionalSince = "&since_time=" + sinceTime;
+    }
+    var pollUrl = "/events?timeout=" + timeout + "&category=" + encodeURIComponent(category) + optionalSince;
+    // how long to wait before starting next longpoll request in each case:
+    var successDelay = 10;  // 10 ms
+    var errorDelay = 3000;  // 3 sec
+    request("GET", pollUrl, null, function(data) {
+        if (data && data.events && data.events.length > 0) {
+            // got events, process them
+            var end = byId("stuff-happening");
+            for (var i = 0; i < data.events.length; i++) {
+                tally(data.events[i]);
+                var row = getFormattedEvent(data.events[i]);
+                if (row) {
+                    end.parentNode.insertBefore(row, end);
+                }
+                sinceTime = data.events[i].timestamp;
+            }
+            // success!  start next longpoll
+            setTimeout(poll, successDelay);
+            return;
+        }
+        if (data && data.events && data.events.length == 0) {
+            console.log("Empty events, that's weird!")
+            // should get a timeout response, not an empty event array
+            // if no events during longpoll window.  so this is weird
+            setTimeout(poll, errorDelay);
+            return;
+        }
+        if (data && data.timeout) {
+            console.log("No events, checking again.");
+            // no events within timeout window, start another longpoll:
+            setTimeout(poll, successDelay);
+            return;
+        }
+        if (data && data.error) {
+            console.log("Error response: " + data.error);
+            console.log("Trying again shortly...")
+            setTimeout(poll, errorDelay);
+            return;
+        }
+        console.log("Didn't get expected event data, try again shortly...");
+        setTimeout(poll, errorDelay);
+    }, function (xhr) {
+        console.log("Error in ajax request--trying again shortly...");
+        setTimeout(poll, 3000);  // 3s
+    });
+})();
+
+
+// Build the table row for an event.  The url comes from the page being
+// proxied, so it only ever goes into the DOM as text, never as html.
+function getFormattedEvent(event) {
+    if (!event || !event.data) {
+        return null;
+    }
+    var i = event.data.indexOf(": ");
+    if (i <= 0) {
+        return null;
+    }
+    var url = event.data.slice(i + 2, event.data.length);
+    var statusText = "???";
+    var rowClass = "status-unknown";
+    var controlLinks = makeElem("p", "item-control-links");
+    var statusArea = makeElem("td");
+    var row = makeElem("tr");
+    function addListLink(className, listName, listUrl) {
+        var link = makeElem("span", className, [listName + " URL"]);
+        link.addEventListener("click", function (event) {
+            event.stopPropagation();
+            addToList(link, row, statusArea, url, listName, listUrl);
+        });
+        controlLinks.appendChild(link);
+    }
+    if (event.data.slice(0,1) == 'A') {
+        statusText = "Allowed";
+        rowClass = "status-allowed";
+        addListLink("add-bl", "Blacklist", "/add-bl");
+    } else if (event.data.slice(0,1) == 'B') {
+        statusText = "Blocked";
+        rowClass = "status-blocked";
+        addListLink("add-wl", "Whitelist", "/add-wl");
+    } else if (event.data.slice(0,1) == 'M') {
+        statusText = "Manual";
+        rowClass = "status-manual";
+        addListLink("add-wl", "Whitelist", "/add-wl");
+        addListLink("add-bl", "Blacklist", "/add-bl");
+    } else if (event.data.slice(0,1) == 'C') {
+        // tracking parameters taken off, the request itself shows up too
+        statusText = "Cleaned";
+        rowClass = "status-cleaned";
+    }
+    var d = new Date(event.timestamp);
+    var t = d.toLocaleTimeString();
+    row.className = "event-item " + rowClass;
+    statusArea.className = "request-status " + rowClass;
+    statusArea.appendChild(document.createTextNode(statusText));
+    row.appendChild(statusArea);
+    row.appendChild(makeElem("td", "", [t.slice(0, t.length - 3)]));
+    row.appendChild(makeElem("td", "", [guessContent(url)]));
+    row.appendChild(makeElem("td", "request-url", [
+        makeElem("span", "url", [url]),
+        makeElem("div", "details-wrapper", [controlLinks])]));
+    row.addEventListener("click", function (event) {
+        row.classList.toggle("details");
+    });
+    return row;
+};
+
+// Add url to the white or black list (listUrl is /add-wl or /add-bl) when
+// one of an event's links is clicked.
+function addToList(link, row, statusArea, url, listName, listUrl) {
+    if (link.classList.contains("clicked")) {
+        // already clicked or succeeded, don't refire
+        return;
+    }
+    link.classList.add("clicked");
+    link.textContent = "Adding...";
+    request("GET", listUrl, {url: url}, function(response) {
+        link.textContent = "Added to " + listName + ".";
+        statusArea.appendChild(document.createElement("br"));
+        statusArea.appendChild(document.createTextNode("Now " + listName + "ed"));
+        statusArea.classList.add("now-" + listName.toLowerCase() + "ed");
+        row.classList.remove("details");
+        // don't remove clicked class to prevent resends
+    }, function(xhr) {
+        link.textContent = "ERROR adding to " + listName + ".";
+        // let user try again.
+        link.classList.remove("clicked");
+    });
+}
+
+function tally(event) {
+    if (!event || !event.data) {
+        return;
+    }
+    if (event.data.slice(0,1) == 'A') {
+        stats.allowed += 1;
+        byId("stat-num-allow").textContent = stats.allowed;
+    } else if (event.data.slice(0,1) == 'B') {
+        stats.blocked += 1;
+        byId("stat-num-block").textContent = stats.blocked;
+    } else if (event.data.slice(0,1) == 'M') {
+        stats.manual += 1;
+        byId("stat-num-manual").textContent = stats.manual;
+    } else {
+        // else unknown event :(
+        return;
+    }
+};
+
+var contentPatterns = {
+    css: new RegExp("^.*css[^\./]*$"),
+    jpg: new RegExp("^.*jpg[^\./]*$"),
+    png: new RegExp("^.*png[^\./]*$"),
+    gif: new RegExp("^.*gif[^\./]*$"),
+    js: new RegExp("^.*js[^\./]*$"),
+    html: new RegExp("^.*html[^\./]*$"),
+    html2: new RegExp("^.*/$")
+};
+
+function guessContent(url) {
+    if (contentPatterns.css.exec(url)) {
+        return "CSS";
+    }
+    if (contentPatterns.jpg.exec(url)) {
+        return "JPEG";
+    }
+    if (contentPatterns.png.exec(url)) {
+        return "PNG";
+    }
+    if (contentPatterns.gif.exec(url)) {
+        return "GIF";
+    }
+    if (contentPatterns.js.exec(url)) {
+        return "JS";
+    }
+    if (contentPatterns.html.exec(url)) {
+        return "HTML";
+    }
+    if (contentPatterns.html2.exec(url)) {
+        return "HTML";
+    }
+    return "?";
+}
+
+byId("toggle-details").addEventListener("click", function(event) {
+    toggleDetailsView();
+});
+
+byId("move-controls").addEventListener("click", function(event) {
+    controlState.upTop = !controlState.upTop;
+    showControlState();
+    window.parent.postMessage({upTop: controlState.upTop}, "*");
+    saveControlState();
+});
+
+byId("corner-controls").addEventListener("click", function(event) {
+    controlState.corner = controlState.corner == "left" ? "right" : "left";
+    showControlState();
+    window.parent.postMessage({corner: controlState.corner}, "*");
+    saveControlState();
+});
+
+byId("collapse-controls").addEventListener("click", function(event) {
+    controlState.collapsed = true;
+    controlState.expanded = false;
+    showControlState();
+    window.parent.postMessage({collapsed: true, expanded: false}, "*");
+    saveControlState();
+});
+
+byId("collapsed-icon").addEventListener("click", function(event) {
+    controlState.collapsed = false;
+    showControlState();
+    window.parent.postMessage({collapsed: false}, "*");
+    saveControlState();
+});
+
+// The element picker runs in the parent page (which we can't get at from
+// here), so it's started with a message.  What gets picked comes back as
+// {pickedSelector} along with the token the pick was started with, and is
+// only saved as a hiding rule for this site once the user confirms it here:
+// the page itself can send us messages, but it can't click in here.
+var pickToken = null;
+var pickedSelector = null;
+
+function randomToken() {
+    var values = new Uint32Array(4);
+    window.crypto.getRandomValues(values);
+    var token = "";
+    for (var i = 0; i < values.length; i++) {
+        token += values[i].toString(16);
+    }
+    return token;
+}
+
+byId("pick-element").addEventListener("click", function(event) {
+    if (!site || !window.crypto) {
+        return;
+    }
+    pickToken = randomToken();
+    controlState.expanded = false;
+    showControlState();
+    window.parent.postMessage({expanded: false, pick: true, pickToken: pickToken}, "*");
+    saveControlState();
+});
+
+// Ask the user whether to keep hiding selector on this site
+function confirmHidingRule(selector) {
+    pickedSelector = selector;
+    byId("pick-confirm-selector").textContent = selector;
+    byId("pick-confirm-site").textContent = site;
+    byId("pick-confirm-error").textContent = "";
+    byId("pick-confirm-save").disabled = false;
+    byId("pick-confirm").classList.add("showme");
+    // big enough to see the question, without remembering it for the site
+    controlState.expanded = true;
+    showControlState();
+    window.parent.postMessage({expanded: true}, "*");
+}
+
+// Done with the picked selector, the parent keeps its preview if saved
+function endHidingRule(saved) {
+    pickedSelector = null;
+    byId("pick-confirm").classList.remove("showme");
+    controlState.expanded = false;
+    showControlState();
+    window.parent.postMessage(saved ? {pickSaved: true, expanded: false} : {pickCancelled: true, expanded: false}, "*");
+}
+
+byId("pick-confirm-save").addEventListener("click", function(event) {
+    var button = this;
+    if (pickedSelector === null || button.disabled) {
+        return;
+    }
+    button.disabled = true;
+    byId("pick-confirm-error").textContent = "Saving...";
+    request("POST", pageControlsConfig.elementHidingUrl, {action: "add", rule: site + "##" + pickedSelector},
+        function(response) {
+            endHidingRule(true);
+        },
+        function(xhr, response) {
+            byId("pick-confirm-error").textContent = "Couldn't save: " +
+                ((response && response.error) || "couldn't save the rule");
+            button.disabled = false;
+        });
+});
+
+byId("pick-confirm-cancel").addEventListener("click", function(event) {
+    if (pickedSelector !== null) {
+        endHidingRule(false);
+    }
+});
+
+// Javascript is turned off for a site with a Content-Security-Policy the
+// proxy adds to its pages, so the page gets reloaded to see the change.
+var scriptsDisabled = pageControlsConfig.scriptsDisabled;
+
+function showScriptsState() {
+    byId("toggle-scripts").textContent = scriptsDisabled ? "Allow JS" : "No JS";
+    setClass(byId("toggle-scripts"), "scripts-off", scriptsDisabled);
+}
+showScriptsState();
+
+byId("toggle-scripts").addEventListener("click", function(event) {
+    var item = this;
+    if (!site || item.classList.contains("clicked")) {
+        return;
+    }
+    item.classList.add("clicked");
+    item.textContent = "Saving...";
+    request("POST", pageControlsConfig.noScriptUrl + "?site=" + encodeURIComponent(site), {disabled: !scriptsDisabled},
+        function(response) {
+            scriptsDisabled = !!(response && response.disabled);
+            showScriptsState();
+            window.parent.postMessage({reload: true}, "*");
+        },
+        function(xhr) {
+            item.textContent = "ERROR";
+            item.classList.remove("clicked");
+        });
+});
+
+function updateRequestColTitle() {
+    var table = byId("event-table");
+    var title = byId("requests-title");
+    if (table.classList.contains("status-allowed")) {
+        title.textContent = "Requests (Allowed)";
+    } else if (table.classList.contains("status-blocked")) {
+        title.textContent = "Requests (Blocked)";
+    } else if (table.classList.contains("status-manual")) {
+        title.textContent = "Requests (Manual)";
+    } else {
+        title.textContent = "Requests";
+    }
+};
+
+// The stats double as filters for the event table: clicking one shows only
+// those events, clicking it again shows everything.
+var statFilters = {
+    "stat-num-allow": "status-allowed",
+    "stat-num-block": "status-blocked",
+    "stat-num-manual": "status-manual"
+};
+
+function toggleEventFilter(statId) {
+    var table = byId("event-table");
+    for (var id in statFilters) {
+        if (id != statId) {
+            byId(id).classList.remove("activated");
+            table.classList.remove(statFilters[id]);
+        }
+    }
+    table.classList.toggle(statFilters[statId]);
+    byId(statId).classList.toggle("activated");
+    updateRequestColTitle();
+    // If we're not showing request details already, show them
+    if (!controlState.expanded) {
+        toggleDetailsView();
+    }
+}
+
+for (var statId in statFilters) {
+    byId(statId).addEventListener("click", (function(id) {
+        return function(event) {
+            toggleEventFilter(id);
+        };
+    })(statId));
+}
+
+// Here "addEventListener" is for standards-compliant web browsers and "attachEvent" is for IE Browsers.
+var eventMethod = window.addEventListener ? "addEventListener" : "attachEvent";
+var eventer = window[eventMethod];
+// onmessage for attachEvent, message for addEventListener
+var messageEvent = eventMethod == "attachEvent" ? "onmessage" : "message";
+// Listen to message from parent window to know when to close detail view
+// this event is sent from the parent page to this iframe when the glass
+// overlay is clicked to dismiss the controlls.  this overlay is not
+// part of controls and thus we need to use events to do parent-to-iframe comms.
+// Picked selectors come back this way too.
+eventer(messageEvent, function (e) {
+    if (e.source === window.parent && e.data && typeof e.data.pickedSelector === "string") {
+        // only for the pick the user started here, and only once
+        if (pickToken !== null && e.data.pickToken === pickToken) {
+            pickToken = null;
+            confirmHidingRule(e.data.pickedSelector);
+        }
+        return;
+    }
+    if (e.data && e.data.closeDetails === true && pickedSelector !== null) {
+        // clicked outside the controls instead of answering
+        endHidingRule(false);
+        return;
+    }
+    if (e.data && e.data.closeDetails === true) {
+        if (controlState.expanded) {
+            // close details
+            // TODO: put close details in func called by both spots
+            // instead of this copy n paste?
+            controlState.expanded = false;
+            showControlState();
+            window.scrollTo(0, 0);
+            saveControlState();
+        }
+    }
+}, false);
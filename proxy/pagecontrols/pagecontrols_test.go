@@ -0,0 +1,71 @@
+package pagecontrols
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+
+	"github.com/jcuga/proxyblock/proxy/controlstate"
+)
+
+var pageConfigLine = regexp.MustCompile(`(?m)^\s*page: (.*),$`)
+
+// The page url ends up inside the controls' inline script, it mustn't be able
+// to close that script or add any markup of its own.
+func TestPageControlsEscapesPageUrl(t *testing.T) {
+	for _, bad := range []string{
+		`"><script>alert(1)</script>`,
+		`</script><script>alert(1)</script>`,
+		`'+alert(1)+'`,
+		`";alert(1);//`,
+		`javascript:alert(1)`,
+	} {
+		t.Run(bad, func(t *testing.T) {
+			pageUrl := "https://example.com/" + bad
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", GetPageControlsUrl(pageUrl), nil)
+			GetPageControlsHandler(controlstate.New())(rec, req)
+			page := rec.Body.String()
+
+			var scripts []html.Token
+			z := html.NewTokenizer(strings.NewReader(page))
+			for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+				if tok := z.Token(); tt == html.StartTagToken && tok.Data == "script" {
+					scripts = append(scripts, tok)
+				}
+			}
+			// pageControlsConfig and page-controls.js, nothing else
+			if len(scripts) != 2 {
+				t.Errorf("got %d scripts, want 2:\n%s", len(scripts), page)
+			}
+
+			match := pageConfigLine.FindStringSubmatch(page)
+			if match == nil {
+				t.Fatalf("page url missing from pageControlsConfig:\n%s", page)
+			}
+			var got string
+			if err := json.Unmarshal([]byte(match[1]), &got); err != nil {
+				t.Fatalf("page url isn't a plain string literal: %s", match[1])
+			}
+			if got != pageUrl {
+				t.Errorf("page url = %q, want %q", got, pageUrl)
+			}
+		})
+	}
+}
+
+func TestGetPageControlsUrl(t *testing.T) {
+	pageUrl := "https://example.com/?a=1&b=</script>#x"
+	u, err := url.Parse(GetPageControlsUrl(pageUrl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Query().Get("page"); got != pageUrl {
+		t.Errorf("page = %q, want %q", got, pageUrl)
+	}
+}
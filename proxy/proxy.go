@@ -1,50 +1,174 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
+	"time"
 
 	"github.com/elazarl/goproxy"
-	"github.com/elazarl/goproxy/ext/html"
 
 	"github.com/jcuga/golongpoll"
 
+	"github.com/jcuga/proxyblock/proxy/blockpage"
+	"github.com/jcuga/proxyblock/proxy/config"
 	"github.com/jcuga/proxyblock/proxy/controls"
+	"github.com/jcuga/proxyblock/proxy/controlstate"
+	"github.com/jcuga/proxyblock/proxy/cosmetic"
+	"github.com/jcuga/proxyblock/proxy/dns"
+	"github.com/jcuga/proxyblock/proxy/headers"
+	"github.com/jcuga/proxyblock/proxy/history"
+	"github.com/jcuga/proxyblock/proxy/htmlfilter"
+	"github.com/jcuga/proxyblock/proxy/inject"
+	"github.com/jcuga/proxyblock/proxy/pac"
 	"github.com/jcuga/proxyblock/proxy/pagecontrols"
+	"github.com/jcuga/proxyblock/proxy/rules"
+	"github.com/jcuga/proxyblock/proxy/settings"
+	"github.com/jcuga/proxyblock/proxy/socks"
+	"github.com/jcuga/proxyblock/proxy/stats"
+	"github.com/jcuga/proxyblock/proxy/upstream"
+	"github.com/jcuga/proxyblock/proxy/urlclean"
 	"github.com/jcuga/proxyblock/proxy/vars"
 	"github.com/jcuga/proxyblock/utils"
 )
 
-func CreateProxy(whiteList, blackList []*regexp.Regexp, verbose bool,
-	whiteListUpdates, blackListUpdates chan string) (*goproxy.ProxyHttpServer, error) {
+func CreateProxy(conf *config.Config, lists *rules.Lists,
+	whiteListUpdates, blackListUpdates chan string,
+	requestHistory *history.History) (*goproxy.ProxyHttpServer, error) {
 	// Start longpoll subscription manager
 	longpollManager, lpErr := golongpoll.StartLongpoll(
 		golongpoll.Options{
 			LoggingEnabled:                 false,
-			MaxLongpollTimeoutSeconds:      120,
-			MaxEventBufferSize:             1000,
-			EventTimeToLiveSeconds:         240,
+			MaxLongpollTimeoutSeconds:      conf.Longpoll.MaxTimeoutSeconds,
+			MaxEventBufferSize:             conf.Longpoll.MaxEventBufferSize,
+			EventTimeToLiveSeconds:         conf.Longpoll.EventTTLSeconds,
 			DeleteEventAfterFirstRetrieval: false,
 		})
 	if lpErr != nil {
-		log.Fatalf("Error creating longpoll manager: %v", lpErr)
+		return nil, fmt.Errorf("error creating longpoll manager: %v", lpErr)
 	}
+
+	controlStates := controlstate.New()
+	if len(conf.Storage.ControlStateFile) > 0 {
+		var csErr error
+		if controlStates, csErr = controlstate.Open(conf.Storage.ControlStateFile); csErr != nil {
+			return nil, fmt.Errorf("error loading page control state: %v", csErr)
+		}
+	}
+
+	cosmeticRules, crErr := rules.LoadCosmeticFiles(append(append([]string(nil), conf.Rules.Whitelists...), conf.Rules.Blacklists...))
+	if crErr != nil {
+		return nil, crErr
+	}
+	cosmeticFilter := cosmetic.New(cosmeticRules)
+	if len(conf.Rules.CosmeticFile) > 0 {
+		if err := cosmeticFilter.OpenUserRules(conf.Rules.CosmeticFile); err != nil {
+			return nil, fmt.Errorf("error loading element hiding rules: %v", err)
+		}
+	}
+
+	blockPages, bpErr := blockpage.New(conf.BlockPage.Template, conf.BlockPage.BadUrlTemplate)
+	if bpErr != nil {
+		return nil, bpErr
+	}
+
 	// Create and start control server for controlling proxy behavior
-	ctlServer := controls.NewControlServer(vars.ProxyControlPort, longpollManager.SubscriptionHandler, whiteListUpdates, blackListUpdates)
+	proxyStats := stats.New()
+	getRulesReport := func() *rules.Report {
+		return rules.Analyze(lists, requestHistory.Urls())
+	}
+	ctlServer := controls.NewControlServer(vars.ProxyControlPort, longpollManager.SubscriptionHandler,
+		whiteListUpdates, blackListUpdates, getRulesReport, proxyStats.Handler, controlStates)
+	ctlServer.HandleFunc(pac.PacUrl, getPacHandler(conf, lists, whiteListUpdates, blackListUpdates, controlStates))
+	ctlServer.HandleFunc(pac.WpadUrl, getPacHandler(conf, lists, whiteListUpdates, blackListUpdates, controlStates))
+	if len(conf.Pac.ListenAddr) > 0 {
+		pac.Serve(conf.Pac.ListenAddr, getPacHandler(conf, lists, whiteListUpdates, blackListUpdates, controlStates))
+	}
+	ctlServer.HandleFunc(settings.CosmeticUrl, settings.GetCosmeticHandler(cosmeticFilter))
 	ctlServer.Serve()
 
-	// Manually allowed/blocked sites:
-	manualWhiteList := make(map[string]bool)
-	manualBlackList := make(map[string]bool)
+	events := &proxyEvents{longpollManager, requestHistory, proxyStats}
+
+	// Whether a host is blocked outright, for when only the host is known.
+	// If its requests can still be answered one by one (intercepted https),
+	// hosts whose rule says what to answer them with aren't.
+	isHostBlocked := func(host, what string, canAnswer bool) bool {
+		checkWhiteBlackListUpdates(lists, whiteListUpdates, blackListUpdates)
+		decision := lists.DecideHost(host)
+		if decision.Action != rules.Blocked || (canAnswer && decision.Rule.HasAnswer()) {
+			return false
+		}
+		log.Printf("BLACKLISTED (%s):  %s %s\n", describeDecision(decision), what, host)
+		events.notifyHost(decision)
+		return true
+	}
 
 	// Create and start our content blocking proxy:
 	proxy := goproxy.NewProxyHttpServer()
-	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	router, routerErr := upstream.NewRouter(conf.Upstream)
+	if routerErr != nil {
+		return nil, routerErr
+	}
+	if router.Enabled() {
+		proxy.Tr.Proxy = router.Proxy
+		proxy.ConnectDial = router.Dial
+	}
+	var cleaner *urlclean.Cleaner
+	if conf.Tracking.Enabled {
+		var cErr error
+		if cleaner, cErr = urlclean.NewCleaner(conf.Tracking); cErr != nil {
+			return nil, cErr
+		}
+	}
+	var headerPolicies *headers.Policies
+	if conf.Headers.Enabled {
+		var hErr error
+		if headerPolicies, hErr = headers.NewPolicies(conf.Headers); hErr != nil {
+			return nil, hErr
+		}
+	}
+	var mitm goproxy.HttpsHandler
+	if conf.Mitm.Enabled {
+		var mitmErr error
+		if mitm, mitmErr = getMitmHandler(conf.Mitm); mitmErr != nil {
+			return nil, mitmErr
+		}
+	}
+	noMitmHosts := utils.ParseHostList(conf.Mitm.NoMitmHosts)
+	proxy.OnRequest().HandleConnect(getConnectHandler(mitm, noMitmHosts, isHostBlocked))
 	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		// only means something on CONNECTs from the SOCKS listener
+		req.Header.Del(socks.StreamTypeHeader)
+		// Plain http tunneled thru CONNECT (from SOCKS) has relative urls
+		if len(req.URL.Host) == 0 {
+			req.URL.Host = req.Host
+			req.URL.Scheme = "http"
+		}
+		// Tracking parameters come off before the rules (or anything else)
+		// see the url
+		if cleaned, removed := cleaner.CleanProxied(req.URL); cleaned != nil {
+			log.Printf("CLEANED: removed %s from %s\n", strings.Join(removed, ", "), req.URL)
+			// Pages the browser is going to are redirected so the address
+			// bar (and bookmarks) get the clean url, with the scheme the
+			// browser asked for.  Frames don't count, the page around
+			// them would never see the redirect.
+			if (req.Method == http.MethodGet || req.Method == http.MethodHead) && inject.IsDocumentRequest(req, true) {
+				// the page's controls go by its url as seen below, ie http
+				page := *cleaned
+				page.Scheme = "http"
+				events.notifyCleaned(cleaned.String(), page.String())
+				resp := newResponse(req, goproxy.ContentTypeText, http.StatusFound, "")
+				resp.Header.Set("Location", cleaned.String())
+				return req, resp
+			}
+			events.notifyCleaned(cleaned.String(), req.Header.Get("Referer"))
+			req.URL = cleaned
+		}
 		// Prevent upgrades to https so we can easily see everything as plain
 		if req.URL.Scheme == "https" {
 			req.URL.Scheme = "http"
@@ -52,131 +176,327 @@ func CreateProxy(whiteList, blackList []*regexp.Regexp, verbose bool,
 		urlString := req.URL.String()
 
 		// Check for any updates to our whitelist/blacklist values
-		checkWhiteBlackListUpdates(manualWhiteList, manualBlackList,
-			whiteListUpdates, blackListUpdates)
+		checkWhiteBlackListUpdates(lists, whiteListUpdates, blackListUpdates)
 
 		// Now apply whitelist/blacklist rules:
-		for _, w := range whiteList {
-			if w.MatchString(urlString) {
-				// whitelisted by rules, but was this specific URL blacklisted
-				// by user?
-				if _, ok := manualBlackList[strings.TrimSpace(urlString)]; ok {
-					// stop trying to find whitelist matches
-					log.Printf("user-DENIED whitelisting:  %s\n", req.URL)
-					break
-				} else {
-					log.Printf("WHITELISTED:  %s\n", req.URL)
-					notifyProxyEvent("Allowed", req, longpollManager)
-					return req, nil
-				}
-			}
-		}
-		// Check if this was explicitly whitelisted by user:
-		if _, ok := manualWhiteList[strings.TrimSpace(urlString)]; ok {
-			// no need to consider blacklists, serve content
-			log.Printf("user-eplicit WHITELISTED:  %s\n", req.URL)
-			notifyProxyEvent("Allowed", req, longpollManager)
+		decision := lists.Decide(urlString)
+		switch decision.Action {
+		case rules.Allowed:
+			log.Printf("WHITELISTED (%s):  %s\n", describeDecision(decision), req.URL)
+			events.notify(decision, req)
 			return req, nil
-		}
-
-		// See if we're manually allowing this page thru on time only
-		if strings.HasSuffix(urlString, vars.ProxyExceptionString) {
+		case rules.ManuallyAllowed:
 			urlString := urlString[:len(urlString)-len(vars.ProxyExceptionString)]
 			u, uErr := url.Parse(urlString)
 			if uErr == nil {
 				req.URL = u
 				log.Printf("MANUALLY ALLOWED: %s\n", req.URL)
-				notifyProxyEvent("Manually Allowed", req, longpollManager)
+				events.notify(decision, req)
 				return req, nil
 			} else {
 				log.Printf("ERROR trying to rewrite URL. Url: %s, Error: %s", urlString, uErr)
-				return req, goproxy.NewResponse(req,
-					goproxy.ContentTypeHtml, http.StatusForbidden,
-					fmt.Sprintf(`<html>
-                            <head><title>BAD URL</title></head>
-                            <body>
-                                <h1>Ehhh.... wut?</h1>
-                                <hr />
-                                <h2>Error rewriting URL:</h2>
-                                <p style="color: black; font-family: monospace; background: #DDDDDD; padding: 20px;">%s</p>
-                                <p>Error:</p>
-                                <p style="color: red; font-family: monospace; background: #DDDDDD; padding: 20px;">%s</p>
-                            </body>
-                        </html>`, urlString, uErr))
-			}
-		}
-		for _, b := range blackList {
-			if b.MatchString(urlString) {
-				log.Printf("BLACKLISTED:  %s\n", req.URL)
-				notifyProxyEvent("Blocked", req, longpollManager)
-				return req, goproxy.NewResponse(req,
-					goproxy.ContentTypeHtml, http.StatusForbidden,
-					fmt.Sprintf(`<html>
-                            <head><title>BLOCKED</title></head>
-                            <body>
-                                <h1>I pity the fool!</h1>
-                                <hr />
-                                <h2>Webpage Blocked</h2>
-                                <p style="color: black; font-family: monospace; background: #DDDDDD; padding: 20px;">%s</p>
-                                <p><a href="%s%s">Continue to Webpage just this once.</a></p>
-                                <p>or...</p>
-                                <p><a href="http://127.0.0.1:%s/add-wl?url=%s&continue_to_page=yes">Add to Whitelist and continue.</a></p>
-                            </body>
-                        </html>`, req.URL, req.URL, vars.ProxyExceptionString,
-						vars.ProxyControlPort, url.QueryEscape(req.URL.String())))
+				contentType, body := blockPages.BadUrl(req, urlString, uErr)
+				return req, newResponse(req, contentType, http.StatusForbidden, body)
 			}
+		case rules.Blocked:
+			log.Printf("BLACKLISTED (%s):  %s\n", describeDecision(decision), req.URL)
+			events.notify(decision, req)
+			status, contentType, body := blockPages.Response(req, decision)
+			return req, newResponse(req, contentType, status, body)
 		}
 		log.Printf("NOT MATCHED: (allow by default) %s\n", req.URL)
-		notifyProxyEvent("Not matched, default allowed", req, longpollManager)
+		events.notify(decision, req)
 		return req, nil
 	})
+	if headerPolicies != nil {
+		// Only requests that actually go out, and after the rules and the page
+		// controls' events, which go by the page's full Referer
+		proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			headerPolicies.Apply(req)
+			return req, nil
+		})
+	}
+
+	htmlFilters, hfErr := rules.LoadHtmlFilterFiles(append(append([]string(nil), conf.Rules.Whitelists...), conf.Rules.Blacklists...))
+	if hfErr != nil {
+		return nil, hfErr
+	}
+	if len(htmlFilters) > 0 {
+		// before the injection, so the controls go into the filtered page
+		addContentFiltering(proxy, htmlFilters, lists)
+	}
+	// before the injection, which lets the page controls' script thru
+	addNoScript(proxy, controlStates)
+	if conf.Injection.Enabled {
+		addControlsInjection(proxy, proxyStats, controlStates, cosmeticFilter)
+	}
+	proxy.Verbose = conf.Logging.Verbose
 
-	proxy.OnResponse(goproxy_html.IsHtml).Do(goproxy_html.HandleString(
-		func(s string, ctx *goproxy.ProxyCtx) string {
+	if len(conf.Socks.ListenAddr) > 0 {
+		socksServer := socks.NewServer(conf.Socks.ListenAddr, proxy, func(host string) bool {
+			return !isHostBlocked(host, "SOCKS5 connection to", false)
+		})
+		socksServer.Serve()
+	}
+	if len(conf.Dns.ListenAddr) > 0 {
+		dnsServer := dns.NewServer(conf.Dns.ListenAddr, conf.Dns.Upstream, conf.Dns.BlockResponse,
+			func(host string) bool {
+				return isHostBlocked(host, "DNS query for", false)
+			})
+		dnsServer.Serve()
+	}
+	return proxy, nil
+}
+
+// Take whatever the html filters for the site say out of html responses.
+func addContentFiltering(proxy *goproxy.ProxyHttpServer, htmlFilters []*rules.HtmlFilterRule, lists *rules.Lists) {
+	proxy.OnResponse(goproxy.ContentTypeIs("text/html")).DoFunc(
+		func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+			if resp == nil || strings.HasPrefix(ctx.Req.URL.Host, "127.0.0.1") {
+				return resp
+			}
+			filters := htmlfilter.ForSite(htmlFilters, ctx.Req.URL.Hostname())
+			if len(filters) == 0 {
+				return resp
+			}
+			pageUrl := ctx.Req.URL.String()
+			if err := inject.DecodeBody(resp); err != nil {
+				log.Printf("WARNING: %s, not filtered. %s", err, pageUrl)
+				return resp
+			}
+			if err := inject.NormalizeCharset(resp); err != nil {
+				log.Printf("WARNING: %s, not filtered. %s", err, pageUrl)
+				return resp
+			}
+			// For :blocked-src, relative to the page and as http like the
+			// requests themselves
+			isBlocked := func(src string) bool {
+				u, err := ctx.Req.URL.Parse(src)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+					return false
+				}
+				u.Scheme = "http"
+				return lists.Decide(u.String()).Action == rules.Blocked
+			}
+			finished := func(removed int, err error) {
+				if err != nil {
+					log.Printf("WARNING: error filtering page: %s. %s", err, pageUrl)
+				}
+				if removed > 0 {
+					log.Printf("FILTERED: %d elements/attributes from %s\n", removed, pageUrl)
+				}
+			}
+			resp.Body = htmlfilter.NewReader(resp.Body, filters, isBlocked, finished)
+			// length is going to change
+			resp.ContentLength = -1
+			resp.Header.Del("Content-Length")
+			return resp
+		})
+}
+
+// Turn javascript off on the pages of sites the user asked for, with a
+// Content-Security-Policy that allows no scripts at all.  The injection adds
+// its nonce to it like it does for the page's own policies, so only the page
+// controls get to run.
+func addNoScript(proxy *goproxy.ProxyHttpServer, controlStates *controlstate.Store) {
+	proxy.OnResponse(goproxy.ContentTypeIs("text/html")).DoFunc(
+		func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+			if resp == nil || strings.HasPrefix(ctx.Req.URL.Host, "127.0.0.1") {
+				return resp
+			}
+			if !inject.IsDocumentRequest(ctx.Req, false) || !controlStates.ScriptsDisabled(ctx.Req.URL.Hostname()) {
+				return resp
+			}
+			resp.Header.Add("Content-Security-Policy", "script-src 'none'")
+			return resp
+		})
+}
+
+// Inject our page controls (and element hiding css) into every successful html
+// response.  Pages that don't end up with the controls are logged and show up
+// in the stats.
+func addControlsInjection(proxy *goproxy.ProxyHttpServer, proxyStats *stats.Stats, controlStates *controlstate.Store,
+	cosmeticFilter *cosmetic.Filter) {
+	proxy.OnResponse(goproxy.ContentTypeIs("text/html")).DoFunc(
+		func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+			if resp == nil {
+				return resp
+			}
 			if strings.HasPrefix(ctx.Req.URL.Host, "http://127.0.0.1:") ||
 				strings.HasPrefix(ctx.Req.URL.Host, "http://127.0.0.1/") ||
 				strings.HasPrefix(ctx.Req.URL.Host, "127.0.0.1/") ||
 				strings.HasPrefix(ctx.Req.URL.Host, "127.0.0.1:") {
 				// Don't inject on our own content.
-				// TODO: move this logic next to IsHtml so this func
-				return s
+				return resp
 			}
 			// Don't inject iframe into responses that aren't successful
 			// ie 2xx response codes.
 			// Mainly this is to avoid injecting on our own block page,
 			// but it probably doesn't make sense for other failed pages either
-			if ctx.Resp.StatusCode < 200 || ctx.Resp.StatusCode >= 300 {
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 				// show page as-is
 				// remember: blocking content is already enforced by this point,
-				return s
+				return resp
 			}
-			match := vars.StartBodyTagMatcher.FindIndex([]byte(s))
-			if match != nil && len(match) >= 2 {
-				// TODO: make this more efficient by using a stream or some sort
-				// of stringbuilder like thing that doesn't require mashing
-				// giant strings together.
-				return s[:match[1]] +
-					// TODO: should this script get injected after the iframe to prevent a potential race condition?
-					getParentControlScript() +
-					"<div id=\"proxyblock-glass-overlay\" onclick=\"glassClose(this);\" style=\"position: fixed; top: 0; right: 0; left: 0; bottom: 0; background: #000000; opacity: 0.3; z-index: 99999998; display: none;\"></div>" +
-					"<div id=\"proxyblock-controls\" style=\"position: fixed; height: 42px; width: 230px; top: 4px; right: 8px; z-index: 99999999;\">" +
-					"<iframe id=\"proxyblock-frame\" scrolling=\"no\" style=\"overflow: hidden; background-color: #FFFFFF; border: 2px solid black; width: 100%; height: 100%;\" " +
-					"src=\"http://127.0.0.1:" + vars.ProxyControlPort + pagecontrols.GetPageControlsUrl(ctx.Req.URL.String()) +
-					"\"></iframe>" +
-					"</div>" +
-					s[match[1]:]
-			} else {
-				log.Printf("WARNING: No starting body tag found, must not be html, no injection.")
-				return s
+			if !inject.IsDocumentRequest(ctx.Req, false) {
+				// html fetched by a script, not a page being viewed
+				return resp
 			}
-		}))
-	proxy.Verbose = verbose
-	return proxy, nil
+			pageUrl := ctx.Req.URL.String()
+			finished := func(err error) {
+				if err == inject.ErrNotDocument {
+					// nothing to report, just not a page
+					log.Printf("%s, no injection. %s", err, pageUrl)
+					return
+				}
+				if err != nil {
+					log.Printf("WARNING: %s, no injection. %s", err, pageUrl)
+				}
+				proxyStats.RecordInjection(pageUrl, err)
+			}
+			if err := inject.DecodeBody(resp); err != nil {
+				finished(err)
+				return resp
+			}
+			if err := inject.NormalizeCharset(resp); err != nil {
+				finished(err)
+				return resp
+			}
+			csp := inject.NewCSPPatch("http://127.0.0.1:" + vars.ProxyControlPort)
+			if err := csp.RewriteHeaders(resp.Header); err != nil {
+				finished(err)
+				return resp
+			}
+			state := controlStates.Get(pagecontrols.SiteForPage(pageUrl))
+			injection := getHidingCss(cosmeticFilter.Stylesheet(ctx.Req.URL.Hostname()), csp.Nonce) +
+				getControlsHtml(pageUrl, csp.Nonce, state)
+			resp.Body = inject.NewReader(resp.Body, injection, csp, finished)
+			// length is going to change
+			resp.ContentLength = -1
+			resp.Header.Del("Content-Length")
+			return resp
+		})
+}
+
+// What gets injected at the start of the page's body: a script that builds the
+// page controls inside a closed shadow root, so the page's css and scripts
+// can't get at them (and ours don't leak into the page).  The only thing added
+// to the page's DOM is the <proxyblock-controls> host element.  The controls
+// start out in whatever state the user last left them for the site.
+func getControlsHtml(pageUrl, nonce string, state controlstate.State) string {
+	// json strings are valid javascript, and json.Marshal escapes <, > and &
+	// so nothing in the url can end the script early.
+	frameUrl, _ := json.Marshal("http://127.0.0.1:" + vars.ProxyControlPort + pagecontrols.GetPageControlsUrl(pageUrl))
+	nonceString, _ := json.Marshal(nonce)
+	css, _ := json.Marshal(controlsCss)
+	stateJson, _ := json.Marshal(state)
+	return "<script type=\"text/javascript\" nonce=\"" + nonce + "\">" +
+		"(function (frameUrl, nonce, css, state) {" + controlsScript + "})(" +
+		string(frameUrl) + ", " + string(nonceString) + ", " + string(css) + ", " + string(stateJson) + ");" +
+		"</script>"
+}
+
+// A <style> block with the element hiding css for the page, if it has any
+func getHidingCss(css, nonce string) string {
+	if len(css) == 0 {
+		return ""
+	}
+	return "<style type=\"text/css\" nonce=\"" + nonce + "\">" + css + "</style>"
+}
+
+// Decides what happens to CONNECTs.  mitm is nil when https isn't
+// intercepted.
+func getConnectHandler(mitm goproxy.HttpsHandler, noMitmHosts utils.HostList,
+	isHostBlocked func(host, what string, canAnswer bool) bool) goproxy.FuncHttpsHandler {
+	return func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		// Tunnels from our SOCKS listener say what they carry, and were
+		// already checked against the host rules.  Anyone else sending
+		// the header doesn't get to skip any of that.
+		streamType := socks.StreamType(ctx.Req)
+		ctx.Req.Header.Del(socks.StreamTypeHeader)
+		switch streamType {
+		case socks.StreamHttp:
+			return goproxy.HTTPMitmConnect, host
+		case socks.StreamRaw:
+			return goproxy.OkConnect, host
+		}
+		hostname := utils.StripPort(host)
+		// Banking, apps with pinned certificates, etc. are tunneled as-is
+		intercept := mitm != nil && !noMitmHosts.Matches(hostname)
+		// Blocked hosts are refused before anything gets decrypted, unless
+		// their rule has a $redirect or $response answer for the requests.
+		if len(streamType) == 0 && isHostBlocked(hostname, "CONNECT to", intercept) {
+			ctx.Resp = newResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden,
+				"Blocked by proxyblock: "+hostname)
+			return goproxy.RejectConnect, host
+		}
+		if !intercept {
+			return goproxy.OkConnect, host
+		}
+		return mitm.HandleConnect(host, ctx)
+	}
 }
 
-func notifyProxyEvent(action string, req *http.Request, lpManager *golongpoll.LongpollManager) {
+// Whitelisted hosts go direct if configured, except where the user turned
+// javascript off, which only the proxy can do.
+func getPacHandler(conf *config.Config, lists *rules.Lists, whiteListUpdates, blackListUpdates chan string,
+	controlStates *controlstate.Store) func(http.ResponseWriter, *http.Request) {
+	return pac.GetPacHandler(conf.ListenAddr, func() []string {
+		if !conf.Pac.DirectWhitelistedHosts {
+			return nil
+		}
+		checkWhiteBlackListUpdates(lists, whiteListUpdates, blackListUpdates)
+		noScript := controlStates.NoScriptSites()
+		direct := make([]string, 0)
+		for _, host := range lists.WhitelistedHosts() {
+			keep := true
+			for _, site := range noScript {
+				if site == host || strings.HasSuffix(site, "."+host) {
+					keep = false
+				}
+			}
+			if keep {
+				direct = append(direct, host)
+			}
+		}
+		return direct
+	})
+}
+
+// Intercept https connections, signing certificates with the configured CA or
+// goproxy's built-in one.
+func getMitmHandler(mitmConf config.MitmConfig) (goproxy.HttpsHandler, error) {
+	if len(mitmConf.CACert) == 0 {
+		return goproxy.AlwaysMitm, nil
+	}
+	ca, err := tls.LoadX509KeyPair(mitmConf.CACert, mitmConf.CAKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading MITM CA: %v", err)
+	}
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("error parsing MITM CA: %v", err)
+	}
+	action := &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(&ca)}
+	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return action, host
+	}), nil
+}
+
+// Everything that wants to know about proxy decisions: the page controls (via
+// longpoll events), the request history and the running stats.
+type proxyEvents struct {
+	lpManager      *golongpoll.LongpollManager
+	requestHistory *history.History
+	stats          *stats.Stats
+}
+
+func (e *proxyEvents) notify(decision rules.Decision, req *http.Request) {
+	e.notifyUrl(decision, req.URL.String(), req.Header.Get("Referer"))
+}
+
+func (e *proxyEvents) notifyUrl(decision rules.Decision, urlString, referer string) {
 	// in the event localhost isn't added to noproxy, don't emit localhost event
-	normUrl := strings.ToLower(req.URL.String())
+	normUrl := strings.ToLower(urlString)
 	if strings.HasPrefix(normUrl, "http://127.0.0.1:") ||
 		strings.HasPrefix(normUrl, "http://127.0.0.1/") ||
 		strings.HasPrefix(normUrl, "127.0.0.1:") ||
@@ -184,83 +504,444 @@ func notifyProxyEvent(action string, req *http.Request, lpManager *golongpoll.Lo
 		// no events for you!
 		return
 	}
+	e.stats.Record(decision)
+	e.requestHistory.Add(history.Entry{
+		Time:    time.Now(),
+		Action:  decision.Action,
+		Url:     urlString,
+		Referer: referer,
+	})
 	var category string
-	if referer := req.Header.Get("Referer"); len(referer) > 0 {
+	if len(referer) > 0 {
 		category = utils.StripProxyExceptionStringFromUrl(referer)
 	} else {
-		category = utils.StripProxyExceptionStringFromUrl(req.URL.String())
+		category = utils.StripProxyExceptionStringFromUrl(urlString)
 	}
-	eventData := action + ": " + req.URL.String()
-	if err := lpManager.Publish(category, eventData); err != nil {
+	eventData := decision.Action + ": " + urlString
+	if err := e.lpManager.Publish(category, eventData); err != nil {
 		log.Printf("ERROR: failed to publish event.  error: %q", err)
 	}
 }
 
-func getParentControlScript() string {
-	return `
-    <script type="text/javascript">
-        function closeControlDetails(wrapper, glass, frame) {
-            wrapper.style.height = "42px";
-            wrapper.style.width = "230px";
-            wrapper.style.maxHeight = null;
-            wrapper.style.maxWidth = null;
-            glass.style.display = "none";
-            frame.setAttribute("scrolling", "no");
+// A host blocked where only the host is known (CONNECT, SOCKS, DNS).  Only
+// counted in the stats: the history is replayed as page requests (see
+// rules.Analyze), which these aren't.
+func (e *proxyEvents) notifyHost(decision rules.Decision) {
+	e.stats.Record(decision)
+}
+
+// A url that had tracking parameters taken off, shown in the page controls of
+// page (or of the url itself if there's no page).
+func (e *proxyEvents) notifyCleaned(urlString, page string) {
+	category := page
+	if len(category) == 0 {
+		category = urlString
+	}
+	category = utils.StripProxyExceptionStringFromUrl(category)
+	if err := e.lpManager.Publish(category, "Cleaned: "+urlString); err != nil {
+		log.Printf("ERROR: failed to publish event.  error: %q", err)
+	}
+}
+
+// Like goproxy.NewResponse, but with the protocol version filled in, since
+// responses inside tunnels (see socks) are written to the client as-is.
+func newResponse(req *http.Request, contentType string, status int, body string) *http.Response {
+	resp := goproxy.NewResponse(req, contentType, status, body)
+	resp.Proto = "HTTP/1.1"
+	resp.ProtoMajor = 1
+	resp.ProtoMinor = 1
+	return resp
+}
+
+// Where a decision came from, for logging
+func describeDecision(d rules.Decision) string {
+	if d.Rule != nil {
+		return d.Rule.Location()
+	}
+	return d.Reason
+}
+
+// Styles for inside the controls' shadow root.  The :host rules are
+// !important since otherwise the page's css would win.
+const controlsCss = `
+    :host { all: initial !important; display: block !important; }
+    .glass { position: fixed; top: 0; right: 0; left: 0; bottom: 0; background: #000000; opacity: 0.3; z-index: 99999998; display: none; }
+    .glass.open { display: block; }
+    .controls { position: fixed; height: 42px; width: 300px; top: 4px; right: 8px; z-index: 99999999; }
+    .controls.bottom { top: auto; bottom: 8px; }
+    .controls.left { right: auto; left: 8px; }
+    .controls.collapsed { width: 60px; }
+    .controls.expanded { height: 90%; width: 90%; max-height: 1000px; max-width: 900px; }
+    .frame { display: block; box-sizing: border-box; overflow: hidden; background-color: #FFFFFF; border: 2px solid black; width: 100%; height: 100%; }
+    .controls.picking { display: none; }
+    .pick-box { position: fixed; pointer-events: none; z-index: 99999998; box-sizing: border-box; background: rgba(255, 80, 80, 0.3); border: 2px solid #FF0000; display: none; }
+    .pick-bar { position: fixed; left: 50%; bottom: 8px; width: 520px; max-width: 90%; transform: translateX(-50%); z-index: 99999999; box-sizing: border-box;
+        padding: 6px; background: #EEEEEE; color: #000000; border: 2px solid black; font: 12px monospace; display: none; }
+    .pick-bar.open { display: block; }
+    .pick-bar input { display: block; width: 100%; box-sizing: border-box; margin: 4px 0; font: 12px monospace; }
+    .pick-bar button { font: bold 12px monospace; margin: 0 4px 0 0; }
+`
+
+// Builds the controls and relays the iframe's messages ({upTop: bool},
+// {expanded: bool}, {corner: "left"/"right"} and {collapsed: bool} from the
+// iframe, {closeDetails: true} back to it).  Also runs the element picker:
+// {pick: true, pickToken} from the iframe starts it, the chosen selector goes
+// back as {pickedSelector, pickToken} for the iframe to confirm with the user
+// and save, which answers with {pickSaved: true} or {pickCancelled: true}.
+// Wrapped in a function taking frameUrl, nonce, css and the saved state by
+// getControlsHtml.
+const controlsScript = `
+    var script = document.currentScript;
+    var host = document.createElement("proxyblock-controls");
+    // older browsers get the controls without the isolation
+    var root = host.attachShadow ? host.attachShadow({mode: "closed"}) : host;
+
+    var style = document.createElement("style");
+    // the page's Content-Security-Policy (if any) allows the nonce
+    style.setAttribute("nonce", nonce);
+    style.appendChild(document.createTextNode(css));
+    var glass = document.createElement("div");
+    glass.className = "glass";
+    var wrapper = document.createElement("div");
+    wrapper.className = "controls";
+    var frame = document.createElement("iframe");
+    frame.className = "frame";
+    frame.setAttribute("scrolling", "no");
+    frame.src = frameUrl;
+    wrapper.appendChild(frame);
+    root.appendChild(style);
+    root.appendChild(glass);
+    root.appendChild(wrapper);
+    if (script && script.parentNode) {
+        script.parentNode.insertBefore(host, script);
+    } else {
+        (document.body || document.documentElement).appendChild(host);
+    }
+
+    var upTop = state.up_top;
+    var expanded = state.expanded;
+    var corner = state.corner;
+    var collapsed = state.collapsed;
+    function update() {
+        wrapper.className = "controls" + (upTop ? "" : " bottom") + (corner == "left" ? " left" : "") +
+            (collapsed ? " collapsed" : "") + (expanded ? " expanded" : "");
+        glass.className = expanded ? "glass open" : "glass";
+        frame.setAttribute("scrolling", expanded ? "auto" : "no");
+    }
+    // before the page gets painted, so the controls show up in the right spot
+    update();
+
+    function listen(target, eventName, handler) {
+        // addEventListener for standards-compliant browsers, attachEvent for IE
+        if (target.addEventListener) {
+            target.addEventListener(eventName, handler, false);
+        } else {
+            target.attachEvent("on" + eventName, handler);
         }
+    }
+
+    listen(glass, "click", function () {
+        expanded = false;
+        update();
+        // tell child iframe to update its dom now that it's supposed to be
+        // in closed-details mode:
+        frame.contentWindow.postMessage({closeDetails: true}, "*");
+    });
 
-        function glassClose(element) {
-            var wrapper = document.getElementById("proxyblock-controls");
-            var frame = document.getElementById("proxyblock-frame");
-            var glass = document.getElementById("proxyblock-glass-overlay");
-            closeControlDetails(wrapper, glass, frame);
-            // tell child iframe via postMessage to update its dom now that
-            // it's supposed to be in closed-details mode:
-            var iframewindow = frame.contentWindow ? frame.contentWindow : frame.contentDocument.defaultView;
-            iframewindow.postMessage({closeDetails: true}, "*");
+    // Listen to message from child IFrame window
+    listen(window, "message", function (e) {
+        if (e.source !== frame.contentWindow) {
+            return;
+        }
+        if (e.origin.slice(0, 17) !== "http://127.0.0.1:" && e.origin.slice(0, 18) !== "https://127.0.0.1:") {
+            return;
+        }
+        if (!e.data) {
+            return;
+        }
+        if (e.data.upTop !== undefined) {
+            // user toggled control position.
+            upTop = !!e.data.upTop;
+        }
+        if (e.data.expanded !== undefined) {
+            // user toggled control exanded state.
+            expanded = !!e.data.expanded;
+        }
+        if (e.data.corner !== undefined) {
+            corner = e.data.corner;
+        }
+        if (e.data.collapsed !== undefined) {
+            collapsed = !!e.data.collapsed;
+        }
+        update();
+        if (e.data.pick === true && typeof e.data.pickToken === "string") {
+            pickToken = e.data.pickToken;
+            startPicker();
+        }
+        if (e.data.pickSaved === true) {
+            stopPicker(true);
         }
+        if (e.data.pickCancelled === true) {
+            stopPicker(false);
+        }
+        if (e.data.reload === true) {
+            // javascript was turned off or on for the site
+            window.location.reload();
+        }
+    });
+
+    // Element picker: highlights whatever is under the mouse, and once
+    // something is clicked proposes a selector for it and previews hiding it.
+    var frameOrigin = frameUrl.split("/").slice(0, 3).join("/");
+    var picking = false;
+    var pickToken = null;
+    var picked = null;
+    var preview = null;
+    var pickBox = document.createElement("div");
+    pickBox.className = "pick-box";
+    var pickBar = document.createElement("div");
+    pickBar.className = "pick-bar";
+    var pickText = document.createElement("div");
+    var pickInput = document.createElement("input");
+    pickInput.type = "text";
+    pickInput.spellcheck = false;
+    function button(label, handler) {
+        var b = document.createElement("button");
+        b.type = "button";
+        b.appendChild(document.createTextNode(label));
+        listen(b, "click", handler);
+        pickBar.appendChild(b);
+        return b;
+    }
+    pickBar.appendChild(pickText);
+    pickBar.appendChild(pickInput);
+    // The iframe has the user confirm the rule before saving it, so the
+    // page can't save rules by sending selectors itself.  The preview stays
+    // up until the iframe says how that went.
+    var pickSave = button("Save...", function () {
+        frame.contentWindow.postMessage({pickedSelector: pickInput.value.trim(), pickToken: pickToken}, frameOrigin);
+        pickToken = null;
+        endPicking();
+    });
+    var pickBroader = button("Broader", function () {
+        if (picked && picked.parentElement && picked.parentElement !== document.body &&
+            picked.parentElement !== document.documentElement) {
+            pick(picked.parentElement);
+        }
+    });
+    button("Cancel", function () {
+        pickToken = null;
+        stopPicker(false);
+    });
+    root.appendChild(pickBox);
+    root.appendChild(pickBar);
+
+    function pickMessage(text) {
+        pickText.textContent = text;
+    }
+
+    function startPicker() {
+        if (picking || !document.addEventListener) {
+            return;
+        }
+        picking = true;
+        picked = null;
+        pickInput.value = "";
+        pickSave.disabled = true;
+        pickBroader.disabled = true;
+        pickMessage("Click the element to hide (Esc cancels)");
+        wrapper.classList.add("picking");
+        pickBar.className = "pick-bar open";
+        document.addEventListener("mouseover", onPickHover, true);
+        document.addEventListener("click", onPickClick, true);
+        window.addEventListener("keydown", onPickKey, true);
+        window.addEventListener("keyup", onPickKey, true);
+        window.addEventListener("keypress", onPickKey, true);
+    }
+
+    // saved leaves the preview in place, since the rule only gets injected
+    // on the next page load
+    function stopPicker(saved) {
+        endPicking();
+        if (!saved) {
+            showPreview("");
+        }
+        preview = null;
+    }
+
+    // Stop following the mouse and put the controls back
+    function endPicking() {
+        picking = false;
+        picked = null;
+        pickBox.style.display = "none";
+        pickBar.className = "pick-bar";
+        wrapper.classList.remove("picking");
+        document.removeEventListener("mouseover", onPickHover, true);
+        document.removeEventListener("click", onPickClick, true);
+        window.removeEventListener("keydown", onPickKey, true);
+        window.removeEventListener("keyup", onPickKey, true);
+        window.removeEventListener("keypress", onPickKey, true);
+    }
+
+    function pickable(el) {
+        if (!el || el.nodeType !== 1 || el === host || el === document.body || el === document.documentElement) {
+            return null;
+        }
+        return el;
+    }
+
+    function highlight(el) {
+        if (!el) {
+            pickBox.style.display = "none";
+            return;
+        }
+        var rect = el.getBoundingClientRect();
+        pickBox.style.top = rect.top + "px";
+        pickBox.style.left = rect.left + "px";
+        pickBox.style.width = rect.width + "px";
+        pickBox.style.height = rect.height + "px";
+        pickBox.style.display = "block";
+    }
+
+    function onPickHover(e) {
+        if (!picked) {
+            highlight(pickable(e.target));
+        }
+    }
+
+    function onPickClick(e) {
+        // clicks on our own bar come from the host element
+        if (e.target === host) {
+            return;
+        }
+        e.preventDefault();
+        e.stopPropagation();
+        var el = pickable(e.target);
+        if (el) {
+            pick(el);
+        }
+    }
+
+    // keep the page's keyboard shortcuts from seeing what's typed into the
+    // selector box
+    function onPickKey(e) {
+        if (e.type === "keydown" && (e.key === "Escape" || e.keyCode === 27)) {
+            e.preventDefault();
+            pickToken = null;
+            stopPicker(false);
+        }
+        if (e.target === host) {
+            e.stopPropagation();
+        }
+    }
+
+    function pick(el) {
+        picked = el;
+        pickInput.value = selectorFor(el);
+        pickBroader.disabled = false;
+        highlight(null);
+        previewSelector();
+    }
 
-        // Here "addEventListener" is for standards-compliant web browsers and "attachEvent" is for IE Browsers.
-        var eventMethod = window.addEventListener ? "addEventListener" : "attachEvent";
-        var eventer = window[eventMethod];
-        // onmessage for attachEvent, message for addEventListener
-        var messageEvent = eventMethod == "attachEvent" ? "onmessage" : "message";
-        // Listen to message from child IFrame window
-        eventer(messageEvent, function (e) {
-            if (e.origin.slice(0, 17) !== "http://127.0.0.1:" && e.origin.slice(0, 18) !== "https://127.0.0.1:") {
+    function showPreview(css) {
+        if (!preview) {
+            if (!css) {
                 return;
             }
-            var wrapper = document.getElementById("proxyblock-controls");
-            var frame = document.getElementById("proxyblock-frame");
-            var glass = document.getElementById("proxyblock-glass-overlay");
-            if (e.data.upTop !== undefined) {
-                // user toggled control position.  reposition:
-                if (e.data.upTop) {
-                    wrapper.style.bottom = null;
-                    wrapper.style.top = "4px";
-                } else {
-                    wrapper.style.top = null;
-                    wrapper.style.bottom = "8px";
-                }
+            preview = document.createElement("style");
+            preview.setAttribute("nonce", nonce);
+            (document.head || document.documentElement).appendChild(preview);
+        }
+        preview.textContent = css;
+    }
+
+    function previewSelector() {
+        var selector = pickInput.value.trim();
+        var count = 0;
+        try {
+            count = selector ? document.querySelectorAll(selector).length : 0;
+        } catch (err) {
+            pickMessage("Not a valid selector");
+            pickSave.disabled = true;
+            showPreview("");
+            return;
+        }
+        showPreview(count ? selector + " { display: none !important; }" : "");
+        pickMessage(count + (count == 1 ? " element" : " elements") + " hidden, save to keep hiding on this site");
+        pickSave.disabled = count == 0;
+    }
+    listen(pickInput, "input", previewSelector);
+
+    function cssEscape(s) {
+        if (window.CSS && window.CSS.escape) {
+            return window.CSS.escape(s);
+        }
+        return s.replace(/[^a-zA-Z0-9_-]/g, function (c) {
+            return "\\" + c;
+        });
+    }
+
+    function matchesOnly(selector, el) {
+        try {
+            var found = document.querySelectorAll(selector);
+            return found.length === 1 && found[0] === el;
+        } catch (err) {
+            return false;
+        }
+    }
+
+    // The tag, id or classes of one element, narrowed down by position
+    // among its siblings if asked to.
+    function selectorPart(el, positional) {
+        if (el.id) {
+            return "#" + cssEscape(el.id);
+        }
+        var part = el.tagName.toLowerCase();
+        var classes = (el.getAttribute("class") || "").split(/\s+/);
+        for (var i = 0; i < classes.length; i++) {
+            if (classes[i]) {
+                part += "." + cssEscape(classes[i]);
             }
-            if (e.data.expanded !== undefined) {
-                // user toggled control exanded state.
-                if (e.data.expanded) {
-                    wrapper.style.height = "90%";
-                    wrapper.style.width = "90%";
-                    wrapper.style.maxHeight = "1000px";
-                    wrapper.style.maxWidth = "900px";
-                    glass.style.display = "block";
-                    frame.setAttribute("scrolling", "auto");
-                } else {
-                    closeControlDetails(wrapper, glass, frame);
+        }
+        if (positional && el.parentElement) {
+            var n = 0;
+            var siblings = el.parentElement.children;
+            for (var j = 0; j < siblings.length; j++) {
+                if (siblings[j].tagName === el.tagName) {
+                    n++;
+                }
+                if (siblings[j] === el) {
+                    break;
                 }
             }
-        }, false);
-    </script>
-    `
-}
+            part += ":nth-of-type(" + n + ")";
+        }
+        return part;
+    }
+
+    // The element by itself if that's enough to single it out, otherwise its
+    // path from the nearest ancestor with an id (or the body).
+    function selectorFor(el) {
+        var selector = selectorPart(el, false);
+        if (matchesOnly(selector, el)) {
+            return selector;
+        }
+        selector = selectorPart(el, true);
+        for (var parent = el.parentElement; parent && parent !== document.body &&
+            parent !== document.documentElement; parent = parent.parentElement) {
+            if (matchesOnly(selector, el)) {
+                return selector;
+            }
+            selector = selectorPart(parent, true) + " > " + selector;
+            if (parent.id) {
+                break;
+            }
+        }
+        return selector;
+    }
+`
 
-func checkWhiteBlackListUpdates(whiteListMap, blackListMap map[string]bool,
+func checkWhiteBlackListUpdates(lists *rules.Lists,
 	whiteListUpdates, blackListUpdates <-chan string) {
 	// Right now we're just adding exact url matching... so just regexp escape
 	// the new urls and add them to the appropriate white/black list.
@@ -272,10 +953,7 @@ wlLoop:
 			fmt.Println("New whitelist entry to add: ", new_url)
 			u := strings.TrimSpace(new_url)
 			if len(u) > 0 {
-				whiteListMap[u] = true
-				// also remove this specific url from manual blacklist
-				// in case user previously blacklisted it
-				delete(blackListMap, u)
+				lists.AddManualWhite(u)
 			} else {
 				log.Printf("ERROR: Invalid whitelist pattern provided: %q",
 					new_url)
@@ -293,10 +971,7 @@ blLoop:
 			fmt.Println("New blacklist entry to add: ", new_url)
 			u := strings.TrimSpace(new_url)
 			if len(u) > 0 {
-				blackListMap[u] = true
-				// also remove this specific url from manual whitelist
-				// in case user previously whitelisted it
-				delete(whiteListMap, u)
+				lists.AddManualBlack(u)
 			} else {
 				log.Printf("ERROR: Invalid blacklist pattern provided: %q",
 					new_url)
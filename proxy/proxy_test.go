@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+
+	"github.com/jcuga/proxyblock/proxy/config"
+	"github.com/jcuga/proxyblock/proxy/history"
+	"github.com/jcuga/proxyblock/proxy/rules"
+	"github.com/jcuga/proxyblock/proxy/surrogates"
+	"github.com/jcuga/proxyblock/proxy/vars"
+	"github.com/jcuga/proxyblock/utils"
+)
+
+const testBlacklist = `||google-analytics.com^$redirect=google-analytics.js
+||pixel.example.com^$response=image
+||ads.example.com
+`
+
+// The proxy CreateProxy builds, blocking with testBlacklist.  Only blocked
+// urls are requested, nothing should get thru to the internet.
+func newTestProxy(t *testing.T, mitmEnabled bool, noMitmHosts []string) (*httptest.Server, *history.History) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "blacklist.txt")
+	if err := ioutil.WriteFile(filename, []byte(testBlacklist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	blacklist, err := rules.LoadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config.Default()
+	conf.Rules.Whitelists = nil
+	conf.Rules.Blacklists = []string{filename}
+	conf.Mitm.Enabled = mitmEnabled
+	conf.Mitm.NoMitmHosts = noMitmHosts
+	// the control server listens on whatever port is free
+	vars.ProxyControlPort = "0"
+	lists := &rules.Lists{BlackList: blacklist, Order: conf.Rules.Order}
+	requestHistory := history.New(conf.Storage.HistorySize)
+	proxy, err := CreateProxy(conf, lists, make(chan string, 1), make(chan string, 1), requestHistory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return server, requestHistory
+}
+
+func newTestClient(t *testing.T, proxy *httptest.Server) *http.Client {
+	proxyUrl, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyUrl),
+		// the test proxy signs with goproxy's own CA
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+}
+
+// ||host rules that say what to answer with get to, over https too
+func TestBlockedHttpsHostRuleResponses(t *testing.T) {
+	proxy, _ := newTestProxy(t, true, nil)
+	client := newTestClient(t, proxy)
+	_, surrogate, _ := surrogates.Get("google-analytics.js")
+	tests := []struct {
+		url             string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{"https://www.google-analytics.com/analytics.js", http.StatusOK, "text/javascript; charset=utf-8", string(surrogate)},
+		{"https://pixel.example.com/p?id=1", http.StatusOK, "image/gif", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			resp, err := client.Get(test.url)
+			if err != nil {
+				t.Fatalf("GET: %v", err)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, test.wantStatus)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != test.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", ct, test.wantContentType)
+			}
+			if len(test.wantBody) > 0 && string(body) != test.wantBody {
+				t.Errorf("body = %q, want the surrogate %q", body, test.wantBody)
+			}
+		})
+	}
+}
+
+// Blocked hosts without an answer, and those that can't be intercepted,
+// don't get a tunnel at all
+func TestBlockedHttpsHostRejectedAtConnect(t *testing.T) {
+	tests := []struct {
+		name        string
+		mitm        bool
+		noMitmHosts []string
+		url         string
+	}{
+		{"no answer", true, nil, "https://ads.example.com/banner.js"},
+		{"mitm off", false, nil, "https://www.google-analytics.com/analytics.js"},
+		{"no_mitm host", true, []string{"google-analytics.com"}, "https://www.google-analytics.com/analytics.js"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy, requestHistory := newTestProxy(t, test.mitm, test.noMitmHosts)
+			resp, err := newTestClient(t, proxy).Get(test.url)
+			if err == nil {
+				resp.Body.Close()
+				t.Fatalf("got status %d, want the CONNECT refused", resp.StatusCode)
+			}
+			// there's no url, so nothing to replay later
+			if entries := requestHistory.Entries(); len(entries) > 0 {
+				t.Errorf("CONNECT went into the history: %+v", entries)
+			}
+		})
+	}
+}
+
+// Hosts on the no-MITM list are tunneled as-is, everything else is decrypted
+func TestConnectHandlerNoMitmHosts(t *testing.T) {
+	mitm, err := getMitmHandler(config.MitmConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	isHostBlocked := func(host, what string, canAnswer bool) bool {
+		return host == "ads.example.com"
+	}
+	noMitmHosts := utils.ParseHostList([]string{"bank.example.com", "10.0.0.0/8"})
+	tests := []struct {
+		host string
+		mitm goproxy.HttpsHandler
+		want goproxy.ConnectActionLiteral
+	}{
+		{"www.example.com:443", mitm, goproxy.ConnectMitm},
+		{"bank.example.com:443", mitm, goproxy.ConnectAccept},
+		{"www.bank.example.com:443", mitm, goproxy.ConnectAccept},
+		{"10.1.2.3:443", mitm, goproxy.ConnectAccept},
+		{"ads.example.com:443", mitm, goproxy.ConnectReject},
+		{"www.example.com:443", nil, goproxy.ConnectAccept},
+	}
+	for _, test := range tests {
+		handler := getConnectHandler(test.mitm, noMitmHosts, isHostBlocked)
+		ctx := &goproxy.ProxyCtx{Req: httptest.NewRequest(http.MethodConnect, "http://"+test.host, nil)}
+		action, host := handler(test.host, ctx)
+		if action.Action != test.want || host != test.host {
+			t.Errorf("CONNECT %s (mitm %v): action %v %s, want %v", test.host, test.mitm != nil, action.Action, host, test.want)
+		}
+	}
+}
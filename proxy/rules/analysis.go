@@ -0,0 +1,133 @@
+package rules
+
+// Replays previously seen request urls against the current rule set to find
+// rules that never do anything: rules with zero hits, rules that are entirely
+// shadowed by earlier rules, and duplicate patterns.
+//
+// Rules are replayed in the order the proxy applies them (see Lists.Decide).
+// With the default ordering whitelist rules come first, so a blacklist rule
+// that only ever matches whitelisted urls is shadowed.
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+type RuleStats struct {
+	Rule *Rule
+	// "whitelist" or "blacklist"
+	List string
+	// Number of urls this rule was the deciding rule for
+	Hits int
+	// Number of urls this rule matched, whether or not it decided them
+	Matches int
+	// Rules that decided urls this rule also matched
+	ShadowedBy []*Rule
+	// Earlier rule with the same pattern, if any
+	DuplicateOf *Rule
+}
+
+// A rule that matched urls but was never the deciding rule
+func (s *RuleStats) Shadowed() bool {
+	return s.Matches > 0 && s.Hits == 0
+}
+
+// A rule that never matched anything at all
+func (s *RuleStats) Unused() bool {
+	return s.Matches == 0
+}
+
+type Report struct {
+	// Number of urls replayed
+	NumUrls int
+	// Stats for every rule, in the order the rules are applied.
+	Rules []*RuleStats
+}
+
+func (r *Report) filter(f func(*RuleStats) bool) []*RuleStats {
+	found := make([]*RuleStats, 0)
+	for _, s := range r.Rules {
+		if f(s) {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+func (r *Report) Unused() []*RuleStats {
+	return r.filter((*RuleStats).Unused)
+}
+
+func (r *Report) Shadowed() []*RuleStats {
+	return r.filter((*RuleStats).Shadowed)
+}
+
+func (r *Report) Duplicates() []*RuleStats {
+	return r.filter(func(s *RuleStats) bool { return s.DuplicateOf != nil })
+}
+
+// Replay urls against the whitelist and blacklist and tally which rules
+// decided and matched each url.  The user's manual lists are not considered.
+func Analyze(lists *Lists, urls []string) *Report {
+	all, names := lists.ordered()
+	report := &Report{NumUrls: len(urls), Rules: make([]*RuleStats, 0, len(all))}
+	seenPatterns := make(map[string]*Rule)
+	for i, r := range all {
+		s := &RuleStats{Rule: r, List: names[i]}
+		// patterns are compiled case insensitive, so compare that way too
+		key := strings.ToLower(r.Pattern)
+		if prev, ok := seenPatterns[key]; ok {
+			s.DuplicateOf = prev
+		} else {
+			seenPatterns[key] = r
+		}
+		report.Rules = append(report.Rules, s)
+	}
+
+	for _, url := range urls {
+		var decider *Rule
+		for _, s := range report.Rules {
+			if !s.Rule.MatchString(url) {
+				continue
+			}
+			s.Matches++
+			if decider == nil {
+				decider = s.Rule
+				s.Hits++
+			} else {
+				s.addShadowedBy(decider)
+			}
+		}
+	}
+	return report
+}
+
+func (s *RuleStats) addShadowedBy(r *Rule) {
+	for _, existing := range s.ShadowedBy {
+		if existing == r {
+			return
+		}
+	}
+	s.ShadowedBy = append(s.ShadowedBy, r)
+}
+
+// Write a plain text version of the report, suitable for a terminal.
+func (r *Report) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Replayed %d requests against %d rules.\n", r.NumUrls, len(r.Rules))
+	fmt.Fprintf(w, "\nRules with zero hits:\n")
+	for _, s := range r.Unused() {
+		fmt.Fprintf(w, "  %s  %s  %s\n", s.Rule.Location(), s.List, s.Rule.Pattern)
+	}
+	fmt.Fprintf(w, "\nRules shadowed by earlier rules:\n")
+	for _, s := range r.Shadowed() {
+		fmt.Fprintf(w, "  %s  %s  %s  (%d matches)\n", s.Rule.Location(), s.List, s.Rule.Pattern, s.Matches)
+		for _, by := range s.ShadowedBy {
+			fmt.Fprintf(w, "      shadowed by %s  %s\n", by.Location(), by.Pattern)
+		}
+	}
+	fmt.Fprintf(w, "\nDuplicate patterns:\n")
+	for _, s := range r.Duplicates() {
+		fmt.Fprintf(w, "  %s  %s  duplicate of %s\n", s.Rule.Location(), s.Rule.Pattern, s.DuplicateOf.Location())
+	}
+}
@@ -0,0 +1,87 @@
+package rules
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	lists := &Lists{
+		WhiteList: mustParse(t, `^http://example\.com/`, "||cdn.example.org"),
+		BlackList: mustParse(t, `/ads/`, "||cdn.example.org", `\.swf$`, `/ADS/`),
+	}
+	urls := []string{
+		"http://example.com/ads/banner.js",
+		"http://other.com/ads/pixel.gif",
+		"http://cdn.example.org/lib.js",
+	}
+	report := Analyze(lists, urls)
+	if report.NumUrls != len(urls) {
+		t.Errorf("NumUrls = %d, want %d", report.NumUrls, len(urls))
+	}
+	// host rules first, whitelist before blacklist
+	tests := []struct {
+		list       string
+		pattern    string
+		hits       int
+		matches    int
+		shadowedBy int
+		duplicate  bool
+	}{
+		{"whitelist", "||cdn.example.org", 1, 1, 0, false},
+		// the same pattern in both lists is a duplicate too
+		{"blacklist", "||cdn.example.org", 0, 1, 1, true},
+		{"whitelist", `^http://example\.com/`, 1, 1, 0, false},
+		{"blacklist", `/ads/`, 1, 2, 1, false},
+		{"blacklist", `\.swf$`, 0, 0, 0, false},
+		{"blacklist", `/ADS/`, 0, 2, 2, true},
+	}
+	if len(report.Rules) != len(tests) {
+		t.Fatalf("got %d rules, want %d", len(report.Rules), len(tests))
+	}
+	for i, test := range tests {
+		s := report.Rules[i]
+		if s.List != test.list || s.Rule.Pattern != test.pattern || s.Hits != test.hits ||
+			s.Matches != test.matches || len(s.ShadowedBy) != test.shadowedBy || (s.DuplicateOf != nil) != test.duplicate {
+			t.Errorf("rule %d: got %s %s hits=%d matches=%d shadowedBy=%d duplicate=%v, want %+v", i, s.List,
+				s.Rule.Pattern, s.Hits, s.Matches, len(s.ShadowedBy), s.DuplicateOf != nil, test)
+		}
+	}
+	if n := len(report.Unused()); n != 1 {
+		t.Errorf("%d unused rules, want 1", n)
+	}
+	if n := len(report.Shadowed()); n != 2 {
+		t.Errorf("%d shadowed rules, want 2", n)
+	}
+	if n := len(report.Duplicates()); n != 2 {
+		t.Errorf("%d duplicates, want 2", n)
+	}
+}
+
+func TestAnalyzeBlacklistFirst(t *testing.T) {
+	lists := &Lists{
+		WhiteList: mustParse(t, `^http://example\.com/`),
+		BlackList: mustParse(t, `/ads/`),
+		Order:     BlacklistFirst,
+	}
+	report := Analyze(lists, []string{"http://example.com/ads/banner.js"})
+	if s := report.Rules[0]; s.List != "blacklist" || s.Hits != 1 {
+		t.Errorf("first rule %s with %d hits, want the blacklist rule with 1", s.List, s.Hits)
+	}
+	if s := report.Rules[1]; !s.Shadowed() {
+		t.Errorf("whitelist rule isn't shadowed: %+v", s)
+	}
+}
+
+func TestReportWriteText(t *testing.T) {
+	lists := &Lists{BlackList: mustParse(t, `/ads/`, `\.swf$`)}
+	var buf bytes.Buffer
+	Analyze(lists, []string{"http://example.com/ads/x.js"}).WriteText(&buf)
+	out := buf.String()
+	for _, want := range []string{"Replayed 1 requests against 2 rules.", `\.swf$`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report is missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package rules
+
+// Element hiding (cosmetic) rules, in adblock's syntax:
+//
+//   ##.ad-banner                  hide .ad-banner on every site
+//   example.com,example.org##.ad  only on these sites (and their subdomains)
+//   ~example.net##.ad             everywhere except example.net
+//   example.com#@#.ad             don't hide .ad on example.com after all
+//
+// They live in the same files as the url rules, and so do html filters
+// (##^, see htmlfilter.go).  A line starting with # is only a cosmetic rule
+// if a valid selector follows the ## right away, so "## comments" and
+// "##### banners #####" are still comments.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The sites before the ## of a cosmetic (or html filter) rule
+type Sites struct {
+	// Sites the rule is limited to, empty for every site.  Lowercase.
+	Domains []string
+	// Sites the rule doesn't apply to (written with a leading ~)
+	ExceptDomains []string
+}
+
+type CosmeticRule struct {
+	Sites
+	Selector string
+	// A #@# rule, which cancels hiding Selector
+	Exception bool
+	// Rule as written in the rule file
+	Pattern string
+	File    string
+	Line    int
+}
+
+var cosmeticDomainsPattern = regexp.MustCompile(`^[a-zA-Z0-9.,~*-]*$`)
+
+// Where this rule was defined, formatted as file:line
+func (r *CosmeticRule) Location() string {
+	return fmt.Sprintf("%s:%d", r.File, r.Line)
+}
+
+// Whether the rule applies on hostname (no port)
+func (r *Sites) AppliesTo(hostname string) bool {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	for _, d := range r.ExceptDomains {
+		if domainMatches(hostname, d) {
+			return false
+		}
+	}
+	if len(r.Domains) == 0 {
+		return true
+	}
+	for _, d := range r.Domains {
+		if domainMatches(hostname, d) {
+			return true
+		}
+	}
+	return false
+}
+
+func domainMatches(hostname, domain string) bool {
+	return domain == "*" || hostname == domain || strings.HasSuffix(hostname, "."+domain)
+}
+
+// Parse a cosmetic rule, ie example.com##.ad-banner
+func ParseCosmeticRule(line string) (*CosmeticRule, error) {
+	line = strings.TrimSpace(line)
+	domains, selector, exception, ok := splitCosmetic(line)
+	if !ok {
+		return nil, fmt.Errorf("not a cosmetic rule: %q", line)
+	}
+	if strings.HasPrefix(selector, "^") {
+		return nil, fmt.Errorf("html filter, not a cosmetic rule: %q", line)
+	}
+	if err := checkSelector(selector); err != nil {
+		return nil, err
+	}
+	sites, err := parseSites(domains)
+	if err != nil {
+		return nil, fmt.Errorf("%v in cosmetic rule: %q", err, line)
+	}
+	return &CosmeticRule{Sites: sites, Selector: selector, Exception: exception, Pattern: line}, nil
+}
+
+func parseSites(domains string) (Sites, error) {
+	var sites Sites
+	for _, d := range strings.Split(strings.ToLower(domains), ",") {
+		d = strings.TrimSpace(d)
+		switch {
+		case len(d) == 0:
+		case strings.HasPrefix(d, "~") && len(d) > 1:
+			sites.ExceptDomains = append(sites.ExceptDomains, d[1:])
+		case strings.HasPrefix(d, "~"):
+			return sites, fmt.Errorf("invalid domain")
+		default:
+			sites.Domains = append(sites.Domains, d)
+		}
+	}
+	return sites, nil
+}
+
+// Split a cosmetic rule into its domains and selector.  ok is false if line
+// isn't one.
+func splitCosmetic(line string) (domains, selector string, exception, ok bool) {
+	sep := "##"
+	i := strings.Index(line, sep)
+	if j := strings.Index(line, "#@#"); j >= 0 && (i < 0 || j < i) {
+		i, sep, exception = j, "#@#", true
+	}
+	if i < 0 {
+		return "", "", false, false
+	}
+	domains, selector = line[:i], line[i+len(sep):]
+	if !cosmeticDomainsPattern.MatchString(domains) || len(selector) == 0 ||
+		strings.TrimSpace(selector) != selector {
+		return "", "", false, false
+	}
+	return domains, selector, exception, true
+}
+
+// Selectors end up in a <style> block, so anything that could end the rule
+// or the block early is refused, and so is anything that doesn't parse as a
+// selector (which could swallow the rules after it).
+func checkSelector(selector string) error {
+	if strings.ContainsAny(selector, "{}<;\n\r") || strings.Contains(selector, "/*") ||
+		strings.HasSuffix(selector, "\\") || !isSelectorList(selector) {
+		return fmt.Errorf("invalid selector: %q", selector)
+	}
+	return nil
+}
+
+// Whether s is a comma separated list of css selectors.  Only the syntax is
+// checked: compound selectors (tag, #id, .class, [attribute], :pseudo(...))
+// joined by combinators.  What's inside a pseudo-class's parentheses only has
+// to be balanced.
+func isSelectorList(s string) bool {
+	p := &selectorParser{s: s}
+	for {
+		if !p.complexSelector() {
+			return false
+		}
+		p.spaces()
+		if p.i == len(s) {
+			return true
+		}
+		if !p.consume(",") {
+			return false
+		}
+		p.spaces()
+	}
+}
+
+type selectorParser struct {
+	s string
+	i int
+}
+
+func (p *selectorParser) complexSelector() bool {
+	if !p.compound() {
+		return false
+	}
+	for {
+		start := p.i
+		p.spaces()
+		combinator := p.consume(">") || p.consume("+") || p.consume("~")
+		if combinator {
+			p.spaces()
+		} else if p.i == start || p.i == len(p.s) || p.s[p.i] == ',' {
+			// no combinator, the selector ends here
+			p.i = start
+			return true
+		}
+		if !p.compound() {
+			return false
+		}
+	}
+}
+
+func (p *selectorParser) compound() bool {
+	found := p.consume("*") || p.ident()
+	for p.i < len(p.s) {
+		switch p.s[p.i] {
+		case '#':
+			p.i++
+			if !p.name() {
+				return false
+			}
+		case '.':
+			p.i++
+			if !p.ident() {
+				return false
+			}
+		case '[':
+			p.i++
+			if !p.attribute() {
+				return false
+			}
+		case ':':
+			p.i++
+			p.consume(":")
+			if !p.ident() {
+				return false
+			}
+			if p.consume("(") && !p.balanced(')') {
+				return false
+			}
+		default:
+			return found
+		}
+		found = true
+	}
+	return found
+}
+
+// [name], [name=value], [name^="value" i] etc, after the [
+func (p *selectorParser) attribute() bool {
+	p.spaces()
+	if !p.ident() {
+		return false
+	}
+	p.spaces()
+	for _, op := range []string{"=", "~=", "|=", "^=", "$=", "*="} {
+		if p.consume(op) {
+			p.spaces()
+			if !p.str() && !p.ident() {
+				return false
+			}
+			p.spaces()
+			if p.consume("i") || p.consume("s") {
+				p.spaces()
+			}
+			break
+		}
+	}
+	return p.consume("]")
+}
+
+// Skip to the closing bracket, minding nested brackets and strings
+func (p *selectorParser) balanced(closing byte) bool {
+	for p.i < len(p.s) {
+		switch c := p.s[p.i]; c {
+		case closing:
+			p.i++
+			return true
+		case '(', '[':
+			p.i++
+			end := byte(')')
+			if c == '[' {
+				end = ']'
+			}
+			if !p.balanced(end) {
+				return false
+			}
+		case ')', ']':
+			return false
+		case '"', '\'':
+			if !p.str() {
+				return false
+			}
+		case '\\':
+			p.i += 2
+		default:
+			p.i++
+		}
+	}
+	return false
+}
+
+func (p *selectorParser) str() bool {
+	if p.i == len(p.s) || (p.s[p.i] != '"' && p.s[p.i] != '\'') {
+		return false
+	}
+	quote := p.s[p.i]
+	for p.i++; p.i < len(p.s); p.i++ {
+		switch p.s[p.i] {
+		case '\\':
+			p.i++
+		case quote:
+			p.i++
+			return true
+		}
+	}
+	return false
+}
+
+// An identifier: doesn't start with a digit, or a hyphen and a digit
+func (p *selectorParser) ident() bool {
+	start := p.i
+	p.consume("-")
+	if p.i < len(p.s) && p.s[p.i] == '-' {
+		p.i++
+	} else if p.i == len(p.s) || !(isNameStart(p.s[p.i]) || p.s[p.i] == '\\') {
+		p.i = start
+		return false
+	}
+	p.name()
+	return true
+}
+
+// One or more name characters (or escapes)
+func (p *selectorParser) name() bool {
+	start := p.i
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		if c == '\\' && p.i+1 < len(p.s) {
+			p.escape()
+		} else if isNameStart(c) || c == '-' || (c >= '0' && c <= '9') {
+			p.i++
+		} else {
+			break
+		}
+	}
+	return p.i > start
+}
+
+// A backslash escape: up to 6 hex digits and an optional space, or any one
+// character
+func (p *selectorParser) escape() {
+	p.i++
+	start := p.i
+	for p.i < len(p.s) && p.i-start < 6 && isHexDigit(p.s[p.i]) {
+		p.i++
+	}
+	if p.i == start {
+		p.i++
+	} else if p.i < len(p.s) && p.s[p.i] == ' ' {
+		p.i++
+	}
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func (p *selectorParser) spaces() {
+	for p.i < len(p.s) && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+func (p *selectorParser) consume(prefix string) bool {
+	if strings.HasPrefix(p.s[p.i:], prefix) {
+		p.i += len(prefix)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package rules
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCosmeticRule(t *testing.T) {
+	for _, line := range []string{
+		"##.ad-banner",
+		"###ad",
+		"example.com,~shop.example.com##div.ad > a[href^=\"https://ads.\"]",
+		"example.com#@#.ad",
+		"##aside:not(.keep), .sponsored ~ p",
+		"##li:nth-child(2n+1)::after",
+		"##[data-ad=\"x\" i]",
+		`##.\31 23`,
+		"##*",
+	} {
+		if _, err := ParseCosmeticRule(line); err != nil {
+			t.Errorf("%q: %v", line, err)
+		}
+	}
+	for _, line := range []string{
+		"##### ads #####",
+		"### ads",
+		"##=====",
+		"##.ad {display:block}",
+		"##.ad</style><script>alert(1)</script>",
+		"##div[",
+		`##a[href="x]`,
+		"##:not(.a",
+		"##.ad,",
+		"##.1ad",
+		"##div >",
+		"##+js(noeval)",
+	} {
+		if r, err := ParseCosmeticRule(line); err == nil {
+			t.Errorf("%q parsed as %+v, want an error", line, r)
+		}
+	}
+}
+
+// Lines that were comments before there were ## rules stay comments
+func TestCommentLinesIgnored(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "rules.txt")
+	lines := []string{
+		"##### ads #####",
+		"## comment",
+		"#@# not an exception",
+		"### Section ###",
+		"##^^^ not an html filter",
+		"#",
+		"##.ad",
+		"##^noscript",
+		"^http://ads\\.",
+	}
+	if err := ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parsed, problems, err := parseFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Errorf("problems: %v", problems)
+	}
+	if len(parsed.cosmetic) != 1 || parsed.cosmetic[0].Selector != ".ad" {
+		t.Errorf("cosmetic rules = %+v, want only .ad", parsed.cosmetic)
+	}
+	if len(parsed.htmlFilters) != 1 || parsed.htmlFilters[0].Tag != "noscript" {
+		t.Errorf("html filters = %+v, want only noscript", parsed.htmlFilters)
+	}
+	if len(parsed.rules) != 1 {
+		t.Errorf("url rules = %v, want 1", parsed.rules)
+	}
+}
+
+// The rule files that ship with proxyblock only have url rules and comments
+func TestShippedRuleFiles(t *testing.T) {
+	for _, filename := range []string{"../../whitelist.txt", "../../blacklist.txt"} {
+		parsed, problems, err := parseFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(problems) > 0 {
+			t.Errorf("%s: problems: %v", filename, problems)
+		}
+		if len(parsed.cosmetic) > 0 || len(parsed.htmlFilters) > 0 {
+			t.Errorf("%s: comments loaded as rules: %+v %+v", filename, parsed.cosmetic, parsed.htmlFilters)
+		}
+		file, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); len(line) > 0 && !strings.HasPrefix(line, "#") {
+				want++
+			}
+		}
+		file.Close()
+		if len(parsed.rules) != want {
+			t.Errorf("%s: %d url rules, want %d", filename, len(parsed.rules), want)
+		}
+	}
+}
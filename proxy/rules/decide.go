@@ -0,0 +1,234 @@
+package rules
+
+// How the proxy decides whether to allow or block a url.  ||host rules are
+// applied first, whitelisted hosts before blacklisted hosts.  Then by default
+// whitelist rules are applied, then urls the user manually whitelisted, then the
+// one-time proxy exception, then the blacklist.  Anything left over is allowed.
+// With BlacklistFirst ordering the blacklist is applied before the whitelist
+// rules instead, so whitelist rules only allow urls no blacklist rule matched.
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/jcuga/proxyblock/proxy/vars"
+	"github.com/jcuga/proxyblock/utils"
+)
+
+// Actions, these are also the prefix of the events the proxy publishes, and
+// the page controls key off of the first letter.
+const (
+	Allowed         = "Allowed"
+	ManuallyAllowed = "Manually Allowed"
+	Blocked         = "Blocked"
+	NotMatched      = "Not matched, default allowed"
+)
+
+// Rule orderings
+const (
+	WhitelistFirst = "whitelist-first"
+	BlacklistFirst = "blacklist-first"
+)
+
+type Decision struct {
+	Action string
+	// Rule that produced the decision, nil if the decision came from the
+	// user's manual lists, the proxy exception string or the default.
+	Rule *Rule
+	// Human readable explanation of the decision
+	Reason string
+}
+
+type Lists struct {
+	WhiteList []*Rule
+	BlackList []*Rule
+	// Exact urls the user allowed/blocked via the page controls.  Once the
+	// proxy is running, only change these via AddManualWhite/AddManualBlack
+	// (which create them if they are nil).
+	ManualWhiteList map[string]bool
+	ManualBlackList map[string]bool
+	// WhitelistFirst (default if empty) or BlacklistFirst
+	Order string
+	// guards the manual lists
+	mu sync.RWMutex
+}
+
+// Allow this exact url from now on
+func (l *Lists) AddManualWhite(url string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ManualWhiteList == nil {
+		l.ManualWhiteList = make(map[string]bool)
+	}
+	l.ManualWhiteList[url] = true
+	// also remove this specific url from manual blacklist
+	// in case user previously blacklisted it
+	delete(l.ManualBlackList, url)
+}
+
+// Block this exact url from now on
+func (l *Lists) AddManualBlack(url string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ManualBlackList == nil {
+		l.ManualBlackList = make(map[string]bool)
+	}
+	l.ManualBlackList[url] = true
+	// also remove this specific url from manual whitelist
+	// in case user previously whitelisted it
+	delete(l.ManualWhiteList, url)
+}
+
+func (l *Lists) Decide(url string) Decision {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if d, decided := l.decideByHost(url); decided {
+		return d
+	}
+	if l.Order == BlacklistFirst {
+		return l.decideBlacklistFirst(url)
+	}
+	trimmed := strings.TrimSpace(url)
+	if w := FirstMatch(l.WhiteList, url); w != nil {
+		// whitelisted by rules, but was this specific URL blacklisted
+		// by user?  If so, keep going.
+		if !l.ManualBlackList[trimmed] {
+			return Decision{Action: Allowed, Rule: w, Reason: "whitelist rule"}
+		}
+	}
+	// Check if this was explicitly whitelisted by user:
+	if l.ManualWhiteList[trimmed] {
+		return Decision{Action: Allowed, Reason: "user whitelisted url"}
+	}
+	// See if we're manually allowing this page thru one time only
+	if strings.HasSuffix(url, vars.ProxyExceptionString) {
+		return Decision{Action: ManuallyAllowed, Reason: "proxy exception string"}
+	}
+	if b := FirstMatch(l.BlackList, url); b != nil {
+		return Decision{Action: Blocked, Rule: b, Reason: "blacklist rule"}
+	}
+	return Decision{Action: NotMatched, Reason: "no rule matched"}
+}
+
+func (l *Lists) decideBlacklistFirst(url string) Decision {
+	trimmed := strings.TrimSpace(url)
+	// The user's explicit choices always win
+	if l.ManualWhiteList[trimmed] {
+		return Decision{Action: Allowed, Reason: "user whitelisted url"}
+	}
+	if strings.HasSuffix(url, vars.ProxyExceptionString) {
+		return Decision{Action: ManuallyAllowed, Reason: "proxy exception string"}
+	}
+	if b := FirstMatch(l.BlackList, url); b != nil {
+		return Decision{Action: Blocked, Rule: b, Reason: "blacklist rule"}
+	}
+	if w := FirstMatch(l.WhiteList, url); w != nil && !l.ManualBlackList[trimmed] {
+		return Decision{Action: Allowed, Rule: w, Reason: "whitelist rule"}
+	}
+	return Decision{Action: NotMatched, Reason: "no rule matched"}
+}
+
+// Apply the ||host rules to a url.  Returns false if no host rule decided it.
+func (l *Lists) decideByHost(url string) (Decision, bool) {
+	hostname := Hostname(url)
+	if len(hostname) == 0 {
+		return Decision{}, false
+	}
+	trimmed := strings.TrimSpace(url)
+	if w := FirstHostMatch(l.WhiteList, hostname); w != nil && !l.ManualBlackList[trimmed] {
+		return Decision{Action: Allowed, Rule: w, Reason: "whitelisted host"}, true
+	}
+	b := FirstHostMatch(l.BlackList, hostname)
+	if b == nil {
+		return Decision{}, false
+	}
+	if l.ManualWhiteList[trimmed] {
+		return Decision{Action: Allowed, Reason: "user whitelisted url"}, true
+	}
+	if strings.HasSuffix(url, vars.ProxyExceptionString) {
+		return Decision{Action: ManuallyAllowed, Reason: "proxy exception string"}, true
+	}
+	return Decision{Action: Blocked, Rule: b, Reason: "blacklisted host"}, true
+}
+
+// Decide what to do with a host when only the host is known, for example
+// for https tunnels and SOCKS connections.  Only Allowed and Blocked are
+// final, NotMatched means the urls on the host still need to be checked.
+func (l *Lists) DecideHost(hostname string) Decision {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	hostname = strings.ToLower(utils.StripPort(hostname))
+	if w := FirstHostMatch(l.WhiteList, hostname); w != nil {
+		return Decision{Action: Allowed, Rule: w, Reason: "whitelisted host"}
+	}
+	b := FirstHostMatch(l.BlackList, hostname)
+	if b == nil {
+		return Decision{Action: NotMatched, Reason: "no host rule matched"}
+	}
+	// Don't block the whole host if the user allowed a url on it
+	for u := range l.ManualWhiteList {
+		if Hostname(u) == hostname {
+			return Decision{Action: NotMatched, Reason: "user whitelisted a url on this host"}
+		}
+	}
+	return Decision{Action: Blocked, Rule: b, Reason: "blacklisted host"}
+}
+
+// Hosts whitelisted by ||host rules, where every url on the host (and its
+// subdomains) is allowed.  Hosts the user manually blocked a url on are left
+// out.
+func (l *Lists) WhitelistedHosts() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	hosts := make([]string, 0)
+	for _, r := range l.WhiteList {
+		if len(r.Host) == 0 {
+			continue
+		}
+		overridden := false
+		for u := range l.ManualBlackList {
+			if h := Hostname(u); h == r.Host || strings.HasSuffix(h, "."+r.Host) {
+				overridden = true
+			}
+		}
+		if !overridden {
+			hosts = append(hosts, r.Host)
+		}
+	}
+	return hosts
+}
+
+// All rules in the order they are applied, along with which list each
+// came from.
+func (l *Lists) ordered() ([]*Rule, []string) {
+	all := make([]*Rule, 0, len(l.WhiteList)+len(l.BlackList))
+	names := make([]string, 0, len(l.WhiteList)+len(l.BlackList))
+	add := func(list []*Rule, name string, hostRules bool) {
+		for _, r := range list {
+			if (len(r.Host) > 0) == hostRules {
+				all = append(all, r)
+				names = append(names, name)
+			}
+		}
+	}
+	add(l.WhiteList, "whitelist", true)
+	add(l.BlackList, "blacklist", true)
+	if l.Order == BlacklistFirst {
+		add(l.BlackList, "blacklist", false)
+		add(l.WhiteList, "whitelist", false)
+	} else {
+		add(l.WhiteList, "whitelist", false)
+		add(l.BlackList, "blacklist", false)
+	}
+	return all, names
+}
+
+// Lowercase host of a url without the port, empty if it can't be parsed.
+func Hostname(rawUrl string) string {
+	u, err := url.Parse(strings.TrimSpace(rawUrl))
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
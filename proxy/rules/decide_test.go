@@ -0,0 +1,109 @@
+package rules
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jcuga/proxyblock/proxy/vars"
+)
+
+func mustParse(t *testing.T, lines ...string) []*Rule {
+	t.Helper()
+	list := make([]*Rule, 0, len(lines))
+	for _, line := range lines {
+		r, err := parseRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, r)
+	}
+	return list
+}
+
+func TestWhitelistedHosts(t *testing.T) {
+	lists := &Lists{WhiteList: mustParse(t, "||example.com", "||example.org", "^http://other\\.net/", "||shop.example.net^")}
+	want := []string{"example.com", "example.org", "shop.example.net"}
+	if got := lists.WhitelistedHosts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("WhitelistedHosts() = %v, want %v", got, want)
+	}
+	// a url the user blocked has to keep going thru the proxy
+	lists.AddManualBlack("http://cdn.example.org/ads.js")
+	want = []string{"example.com", "shop.example.net"}
+	if got := lists.WhitelistedHosts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("WhitelistedHosts() after a manual block = %v, want %v", got, want)
+	}
+}
+
+func TestDecideOrdering(t *testing.T) {
+	const (
+		ad      = "http://example.com/ads/banner.js"
+		page    = "http://example.com/index.html"
+		tracker = "http://tracker.example.net/pixel.gif"
+		cdn     = "http://cdn.example.org/lib.js"
+	)
+	excepted := "http://example.com/ads/page.html" + vars.ProxyExceptionString
+	white := []string{`^http://example\.com/`, "||cdn.example.org"}
+	black := []string{`/ads/`, "||tracker.example.net", "||example.org"}
+	tests := []struct {
+		name   string
+		order  string
+		manual func(l *Lists)
+		url    string
+		want   string
+		reason string
+	}{
+		{"whitelist rule first", WhitelistFirst, nil, ad, Allowed, "whitelist rule"},
+		{"default is whitelist first", "", nil, ad, Allowed, "whitelist rule"},
+		{"blacklist rule first", BlacklistFirst, nil, ad, Blocked, "blacklist rule"},
+		{"whitelist rule after blacklist", BlacklistFirst, nil, page, Allowed, "whitelist rule"},
+		{"host rule", WhitelistFirst, nil, tracker, Blocked, "blacklisted host"},
+		{"whitelisted host before blacklisted host", BlacklistFirst, nil, cdn, Allowed, "whitelisted host"},
+		{"nothing matched", WhitelistFirst, nil, "http://other.com/", NotMatched, "no rule matched"},
+		{"manual block beats whitelist rule", WhitelistFirst,
+			func(l *Lists) { l.AddManualBlack(ad) }, ad, Blocked, "blacklist rule"},
+		{"manual allow beats blacklist rule", BlacklistFirst,
+			func(l *Lists) { l.AddManualWhite(ad) }, ad, Allowed, "user whitelisted url"},
+		{"manual allow beats host rule", WhitelistFirst,
+			func(l *Lists) { l.AddManualWhite(tracker) }, tracker, Allowed, "user whitelisted url"},
+		{"manual block beats whitelisted host", WhitelistFirst,
+			func(l *Lists) { l.AddManualBlack(cdn) }, cdn, Blocked, "blacklisted host"},
+		{"exception string", BlacklistFirst, nil, excepted, ManuallyAllowed, "proxy exception string"},
+		{"exception string on blocked host", WhitelistFirst, nil,
+			tracker + vars.ProxyExceptionString, ManuallyAllowed, "proxy exception string"},
+	}
+	for _, test := range tests {
+		lists := &Lists{WhiteList: mustParse(t, white...), BlackList: mustParse(t, black...), Order: test.order}
+		if test.manual != nil {
+			test.manual(lists)
+		}
+		d := lists.Decide(test.url)
+		if d.Action != test.want || d.Reason != test.reason {
+			t.Errorf("%s: Decide(%q) = %s (%s), want %s (%s)", test.name, test.url, d.Action, d.Reason,
+				test.want, test.reason)
+		}
+	}
+}
+
+func TestDecideHost(t *testing.T) {
+	lists := &Lists{WhiteList: mustParse(t, "||cdn.example.org"), BlackList: mustParse(t, "||example.org", "/ads/")}
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"cdn.example.org", Allowed},
+		{"www.example.org:443", Blocked},
+		{"EXAMPLE.ORG", Blocked},
+		{"example.com", NotMatched},
+	}
+	for _, test := range tests {
+		if got := lists.DecideHost(test.host).Action; got != test.want {
+			t.Errorf("DecideHost(%q) = %s, want %s", test.host, got, test.want)
+		}
+	}
+	// a url the user allowed keeps the rest of its host reachable at the
+	// url level
+	lists.AddManualWhite("http://www.example.org/page.html")
+	if got := lists.DecideHost("www.example.org").Action; got != NotMatched {
+		t.Errorf("DecideHost after a manual allow = %s, want %s", got, NotMatched)
+	}
+}
@@ -0,0 +1,115 @@
+package rules
+
+// Html filters take things out of pages as they pass thru the proxy, for what
+// blocking requests can't reach: inline scripts, iframes and tracking pixels
+// written right into the page, event handler attributes.  Same sites syntax
+// as cosmetic rules, with ##^ followed by what to filter:
+//
+//   example.com##^script:has-text(adsbygoogle)    inline scripts containing text
+//   ##^script:has-text(/fbq\(['"]init/)           ... or matching a regex
+//   ##^iframe:blocked-src                         iframes the url rules block
+//   ##^noscript                                   every <noscript>
+//   example.com##^[on*]                           event handler attributes
+//
+// A tag without a condition removes every one of those elements, with
+// everything inside them.  [name] strips that attribute (a trailing * matches
+// any attribute starting with name) from every element instead.  #@#^ cancels
+// a filter on the sites listed.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type HtmlFilterRule struct {
+	Sites
+	// Element to remove, lowercase.  Empty for attribute filters.
+	Tag string
+	// Only remove Tag if its text contains HasText, or matches HasTextRegexp
+	HasText       string
+	HasTextRegexp *regexp.Regexp
+	// Only remove Tag if its src is blocked by the url rules
+	BlockedSrc bool
+	// Attribute to strip, lowercase.  A trailing * makes it a prefix.
+	StripAttr string
+	// A #@#^ rule, which cancels the filter
+	Exception bool
+	// What comes after ##^, used to match exceptions to filters
+	Filter string
+	// Rule as written in the rule file
+	Pattern string
+	File    string
+	Line    int
+}
+
+var (
+	htmlFilterTagPattern  = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+	htmlFilterAttrPattern = regexp.MustCompile(`^\[([a-z][a-z0-9_:.-]*\*?)\]$`)
+)
+
+// Where this rule was defined, formatted as file:line
+func (r *HtmlFilterRule) Location() string {
+	return fmt.Sprintf("%s:%d", r.File, r.Line)
+}
+
+// Whether the text of an element is what the rule is looking for
+func (r *HtmlFilterRule) MatchesText(text string) bool {
+	if r.HasTextRegexp != nil {
+		return r.HasTextRegexp.MatchString(text)
+	}
+	return strings.Contains(text, r.HasText)
+}
+
+// Whether the rule strips the attribute called name (lowercase)
+func (r *HtmlFilterRule) StripsAttr(name string) bool {
+	if strings.HasSuffix(r.StripAttr, "*") {
+		return strings.HasPrefix(name, r.StripAttr[:len(r.StripAttr)-1])
+	}
+	return len(r.StripAttr) > 0 && name == r.StripAttr
+}
+
+// Parse an html filter, ie example.com##^script:has-text(ads)
+func ParseHtmlFilterRule(line string) (*HtmlFilterRule, error) {
+	line = strings.TrimSpace(line)
+	domains, filter, exception, ok := splitCosmetic(line)
+	if !ok || !strings.HasPrefix(filter, "^") || len(filter) == 1 {
+		return nil, fmt.Errorf("not an html filter: %q", line)
+	}
+	filter = filter[1:]
+	sites, err := parseSites(domains)
+	if err != nil {
+		return nil, fmt.Errorf("%v in html filter: %q", err, line)
+	}
+	r := &HtmlFilterRule{Sites: sites, Exception: exception, Filter: filter, Pattern: line}
+	if m := htmlFilterAttrPattern.FindStringSubmatch(strings.ToLower(filter)); m != nil {
+		r.StripAttr = m[1]
+		return r, nil
+	}
+	tag, condition := filter, ""
+	if i := strings.Index(filter, ":"); i >= 0 {
+		tag, condition = filter[:i], filter[i:]
+	}
+	r.Tag = strings.ToLower(tag)
+	if !htmlFilterTagPattern.MatchString(r.Tag) {
+		return nil, fmt.Errorf("invalid html filter, expected a tag name or [attribute]: %q", line)
+	}
+	switch {
+	case len(condition) == 0:
+	case condition == ":blocked-src":
+		r.BlockedSrc = true
+	case strings.HasPrefix(condition, ":has-text(") && strings.HasSuffix(condition, ")"):
+		text := condition[len(":has-text(") : len(condition)-1]
+		if len(text) > 2 && strings.HasPrefix(text, "/") && strings.HasSuffix(text, "/") {
+			if r.HasTextRegexp, err = regexp.Compile(text[1 : len(text)-1]); err != nil {
+				return nil, fmt.Errorf("invalid has-text pattern: %v", err)
+			}
+		} else if len(text) == 0 {
+			return nil, fmt.Errorf("empty has-text in html filter: %q", line)
+		}
+		r.HasText = text
+	default:
+		return nil, fmt.Errorf("unknown html filter condition %q, expected :has-text() or :blocked-src", condition)
+	}
+	return r, nil
+}
@@ -0,0 +1,88 @@
+package rules
+
+import "testing"
+
+func TestParseHtmlFilterRule(t *testing.T) {
+	tests := []struct {
+		line       string
+		wantTag    string
+		wantText   string
+		wantRegexp bool
+		wantSrc    bool
+		wantAttr   string
+		wantExcept bool
+	}{
+		{"##^noscript", "noscript", "", false, false, "", false},
+		{"example.com##^SCRIPT:has-text(ads)", "script", "ads", false, false, "", false},
+		{`##^script:has-text(/fbq\(['"]init/)`, "script", `/fbq\(['"]init/`, true, false, "", false},
+		{"##^iframe:blocked-src", "iframe", "", false, true, "", false},
+		{"example.com##^[on*]", "", "", false, false, "on*", false},
+		{"##^[Ping]", "", "", false, false, "ping", false},
+		{"example.com#@#^script", "script", "", false, false, "", true},
+	}
+	for _, test := range tests {
+		r, err := ParseHtmlFilterRule(test.line)
+		if err != nil {
+			t.Errorf("%q: %v", test.line, err)
+			continue
+		}
+		if r.Tag != test.wantTag || r.HasText != test.wantText || (r.HasTextRegexp != nil) != test.wantRegexp ||
+			r.BlockedSrc != test.wantSrc || r.StripAttr != test.wantAttr || r.Exception != test.wantExcept {
+			t.Errorf("%q parsed as %+v", test.line, r)
+		}
+	}
+}
+
+func TestParseHtmlFilterRuleErrors(t *testing.T) {
+	for _, line := range []string{
+		"##.ad",
+		"##^",
+		"##^div.ad",
+		"##^[on*",
+		"##^script:has-text()",
+		"##^script:has-text(/(/)",
+		"##^script:contains(ads)",
+		"~##^script",
+	} {
+		if r, err := ParseHtmlFilterRule(line); err == nil {
+			t.Errorf("%q parsed as %+v, want an error", line, r)
+		}
+	}
+}
+
+func TestHtmlFilterMatching(t *testing.T) {
+	attr, _ := ParseHtmlFilterRule("##^[on*]")
+	exact, _ := ParseHtmlFilterRule("##^[ping]")
+	for _, test := range []struct {
+		rule *HtmlFilterRule
+		name string
+		want bool
+	}{
+		{attr, "onclick", true},
+		{attr, "on", true},
+		{attr, "href", false},
+		{exact, "ping", true},
+		{exact, "pings", false},
+	} {
+		if got := test.rule.StripsAttr(test.name); got != test.want {
+			t.Errorf("%s StripsAttr(%q) = %v, want %v", test.rule.Pattern, test.name, got, test.want)
+		}
+	}
+
+	text, _ := ParseHtmlFilterRule("##^script:has-text(ads)")
+	re, _ := ParseHtmlFilterRule("##^script:has-text(/^ad[0-9]/)")
+	for _, test := range []struct {
+		rule *HtmlFilterRule
+		text string
+		want bool
+	}{
+		{text, "load(ads)", true},
+		{text, "load()", false},
+		{re, "ad1()", true},
+		{re, "x ad1()", false},
+	} {
+		if got := test.rule.MatchesText(test.text); got != test.want {
+			t.Errorf("%s MatchesText(%q) = %v, want %v", test.rule.Pattern, test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package rules
+
+// Sanity checks for rule files so mistakes can be caught from the shell
+// before (re)starting the proxy.
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Problem struct {
+	File string
+	Line int
+	// Warnings don't prevent a rule file from loading
+	Warning bool
+	Message string
+}
+
+func (p Problem) Error() string {
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+}
+
+func (p Problem) String() string {
+	if p.Warning {
+		return "warning: " + p.Error()
+	}
+	return "error: " + p.Error()
+}
+
+// Check the given rule files for invalid patterns, duplicates and patterns
+// that can never match.  Files that can't be read are returned as err.
+func Lint(filenames ...string) ([]Problem, error) {
+	problems := make([]Problem, 0)
+	seen := make(map[string]*Rule)
+	// cosmetic rules and html filters, by pattern, to where they were first seen
+	seenOther := make(map[string]string)
+	duplicate := func(pattern, file string, line int, location string) {
+		key := strings.ToLower(pattern)
+		if prev, ok := seenOther[key]; ok {
+			problems = append(problems, Problem{File: file, Line: line, Warning: true,
+				Message: fmt.Sprintf("duplicate of %s", prev)})
+		} else {
+			seenOther[key] = location
+		}
+	}
+	for _, filename := range filenames {
+		parsed, fileProblems, err := parseFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, fileProblems...)
+		for _, r := range parsed.rules {
+			key := strings.ToLower(r.Pattern)
+			if prev, ok := seen[key]; ok {
+				problems = append(problems, Problem{File: r.File, Line: r.Line, Warning: true,
+					Message: fmt.Sprintf("duplicate of %s", prev.Location())})
+			} else {
+				seen[key] = r
+			}
+			// The proxy rewrites https urls to http before applying rules
+			if strings.HasPrefix(strings.ToLower(strings.TrimPrefix(r.Pattern, "^")), "https://") {
+				problems = append(problems, Problem{File: r.File, Line: r.Line, Warning: true,
+					Message: "pattern starts with https://, but urls are matched as http://"})
+			}
+		}
+		for _, c := range parsed.cosmetic {
+			duplicate(c.Pattern, c.File, c.Line, c.Location())
+		}
+		for _, f := range parsed.htmlFilters {
+			duplicate(f.Pattern, f.File, f.Line, f.Location())
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,89 @@
+package rules
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeRuleFile(t *testing.T, dir, name string, lines ...string) string {
+	t.Helper()
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLint(t *testing.T) {
+	dir := t.TempDir()
+	white := writeRuleFile(t, dir, "white.txt",
+		"# comment",
+		`^http://example\.com/`,
+		"[unclosed",
+		"^https://secure\\.example\\.com/",
+		"||bad/host",
+		"example.com##.ad",
+	)
+	black := writeRuleFile(t, dir, "black.txt",
+		"",
+		`/ADS/`,
+		`/ads/`,
+		`^HTTP://EXAMPLE\.COM/`,
+		"example.com##.ad",
+		"example.com##{color:red}",
+	)
+	problems, err := Lint(white, black)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type finding struct {
+		file    string
+		line    int
+		warning bool
+		message string
+	}
+	// problems parsing a file come before what's found in its rules
+	want := []finding{
+		{white, 3, false, "invalid pattern"},
+		{white, 5, false, "invalid host rule"},
+		{white, 4, true, "pattern starts with https://"},
+		{black, 6, false, "invalid selector"},
+		{black, 3, true, "duplicate of " + black + ":2"},
+		{black, 4, true, "duplicate of " + white + ":2"},
+		{black, 5, true, "duplicate of " + white + ":6"},
+	}
+	got := make([]finding, 0, len(problems))
+	for _, p := range problems {
+		f := finding{p.File, p.Line, p.Warning, p.Message}
+		// only compare the start of messages that quote the rule
+		for _, w := range want {
+			if w.file == p.File && w.line == p.Line && strings.HasPrefix(p.Message, w.message) {
+				f.message = w.message
+			}
+		}
+		got = append(got, f)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Lint() = %v, want %v", problems, want)
+	}
+}
+
+func TestLintMissingFile(t *testing.T) {
+	if _, err := Lint(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("Lint() of a missing file didn't fail")
+	}
+}
+
+func TestProblemString(t *testing.T) {
+	p := Problem{File: "black.txt", Line: 7, Message: "invalid pattern"}
+	if got := p.String(); got != "error: black.txt:7: invalid pattern" {
+		t.Errorf("String() = %q", got)
+	}
+	p.Warning = true
+	if got := p.String(); got != "warning: black.txt:7: invalid pattern" {
+		t.Errorf("String() = %q", got)
+	}
+}
@@ -0,0 +1,306 @@
+package rules
+
+// Whitelist/blacklist rules loaded from rule files.  Each rule remembers which
+// file and line it came from so that proxy decisions can be traced back to the
+// exact pattern that produced them.
+//
+// Each non-comment line of a rule file is either a regular expression that is
+// matched against the full url, or a host rule of the form ||example.com
+// which matches every url on example.com and its subdomains.  Host rules are
+// applied before the regular expressions and are also used wherever only the
+// host is known (https tunnels, SOCKS connections).  Lines with ## are element
+// hiding rules instead, see cosmetic.go.
+//
+// A blacklist rule can end with $response=<kind> to pick what blocked requests
+// get back instead of guessing from the kind of resource requested, for example
+// ||ads.example.com^$response=image, or with $redirect=<surrogate> to have a
+// built-in stand-in script served in place of what it blocks.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jcuga/proxyblock/proxy/surrogates"
+)
+
+type Rule struct {
+	*regexp.Regexp
+	// Pattern as written in the rule file (without the ignore case option)
+	Pattern string
+	File    string
+	Line    int
+	// Set for ||host rules, lowercase
+	Host string
+	// What to send back for urls this rule blocks (one of the Response*
+	// kinds), empty to go by the kind of resource requested.
+	Response string
+	// Name of the surrogate (see the surrogates package) served in place of
+	// urls this rule blocks, if any.
+	Redirect string
+}
+
+// What a blocked request can get back, see the $response rule option
+const (
+	ResponsePage      = "page"
+	ResponseImage     = "image"
+	ResponseScript    = "script"
+	ResponseStyle     = "style"
+	ResponseNoContent = "nocontent"
+)
+
+var responseKinds = map[string]bool{
+	ResponsePage:      true,
+	ResponseImage:     true,
+	ResponseScript:    true,
+	ResponseStyle:     true,
+	ResponseNoContent: true,
+}
+
+// Whether the rule says what blocked requests get back ($response or
+// $redirect)
+func (r *Rule) HasAnswer() bool {
+	return len(r.Response) > 0 || len(r.Redirect) > 0
+}
+
+// Where this rule was defined, formatted as file:line
+func (r *Rule) Location() string {
+	return fmt.Sprintf("%s:%d", r.File, r.Line)
+}
+
+// Parse a file of regular expressions, ignoring comments/whitespace
+func LoadFile(filename string) ([]*Rule, error) {
+	parsed, err := loadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parsed.rules, nil
+}
+
+// Load and concatenate the rules from several files, in the order given
+func LoadFiles(filenames []string) ([]*Rule, error) {
+	all := make([]*Rule, 0)
+	for _, filename := range filenames {
+		list, err := LoadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, list...)
+	}
+	return all, nil
+}
+
+// Load the cosmetic (element hiding) rules from several files, in the order
+// given
+func LoadCosmeticFiles(filenames []string) ([]*CosmeticRule, error) {
+	all := make([]*CosmeticRule, 0)
+	for _, filename := range filenames {
+		parsed, err := loadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, parsed.cosmetic...)
+	}
+	return all, nil
+}
+
+// Load the html filters from several files, in the order given
+func LoadHtmlFilterFiles(filenames []string) ([]*HtmlFilterRule, error) {
+	all := make([]*HtmlFilterRule, 0)
+	for _, filename := range filenames {
+		parsed, err := loadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, parsed.htmlFilters...)
+	}
+	return all, nil
+}
+
+// Everything in a rule file
+type ruleFile struct {
+	rules       []*Rule
+	cosmetic    []*CosmeticRule
+	htmlFilters []*HtmlFilterRule
+}
+
+// Parse a rule file, failing on the first problem that isn't just a warning
+func loadFile(filename string) (*ruleFile, error) {
+	parsed, problems, err := parseFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range problems {
+		if !p.Warning {
+			return nil, p
+		}
+	}
+	return parsed, nil
+}
+
+// Parses every line of a rule file, collecting problems instead of giving up
+// on the first bad pattern.  The error is only set if the file couldn't be
+// read at all.
+func parseFile(filename string) (*ruleFile, []Problem, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening %s: %v", filename, err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	parsed := &ruleFile{
+		rules:       make([]*Rule, 0),
+		cosmetic:    make([]*CosmeticRule, 0),
+		htmlFilters: make([]*HtmlFilterRule, 0),
+	}
+	problems := make([]Problem, 0)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		// Lines starting with # that don't parse as ## rules are comments
+		comment := strings.HasPrefix(line, "#")
+		if _, selector, _, ok := splitCosmetic(line); ok && strings.HasPrefix(selector, "^") {
+			f, err := ParseHtmlFilterRule(line)
+			if err != nil {
+				if !comment {
+					problems = append(problems, Problem{File: filename, Line: lineNum,
+						Message: err.Error()})
+				}
+				continue
+			}
+			f.File = filename
+			f.Line = lineNum
+			parsed.htmlFilters = append(parsed.htmlFilters, f)
+			continue
+		} else if ok {
+			c, err := ParseCosmeticRule(line)
+			if err != nil {
+				if !comment {
+					problems = append(problems, Problem{File: filename, Line: lineNum,
+						Message: err.Error()})
+				}
+				continue
+			}
+			c.File = filename
+			c.Line = lineNum
+			parsed.cosmetic = append(parsed.cosmetic, c)
+			continue
+		}
+		// ignore blank/whitespace lines and comments
+		if len(line) == 0 || comment {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			problems = append(problems, Problem{File: filename, Line: lineNum,
+				Message: err.Error()})
+			continue
+		}
+		r.File = filename
+		r.Line = lineNum
+		parsed.rules = append(parsed.rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error reading %s: %v", filename, err)
+	}
+	return parsed, problems, nil
+}
+
+func parseRule(line string) (*Rule, error) {
+	pattern, opts, err := splitOptions(line)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(pattern, "||") {
+		// optional trailing separator, as in adblock's ||example.com^
+		host := strings.ToLower(strings.TrimSuffix(pattern[2:], "^"))
+		if len(host) == 0 || strings.ContainsAny(host, "/:*?# \t") {
+			return nil, fmt.Errorf("invalid host rule: %q", line)
+		}
+		r := regexp.MustCompile(`(?i)^[a-z][a-z0-9+.-]*://([^/?#@]*\.)?` +
+			regexp.QuoteMeta(host) + `(:\d+)?([/?#]|$)`)
+		return &Rule{Regexp: r, Pattern: line, Host: host, Response: opts.response, Redirect: opts.redirect}, nil
+	}
+	// add ignore case option to regex and compile it
+	r, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	return &Rule{Regexp: r, Pattern: line, Response: opts.response, Redirect: opts.redirect}, nil
+}
+
+type ruleOptions struct {
+	response string
+	redirect string
+}
+
+// Split the options off the end of a rule: a $ followed by comma separated
+// response=<kind> and redirect=<surrogate>.  A regex can't match anything
+// after a $ anchor anyway, so this can't clash with a real pattern.
+func splitOptions(line string) (string, ruleOptions, error) {
+	var opts ruleOptions
+	i := strings.LastIndex(line, "$")
+	if i < 0 {
+		return line, opts, nil
+	}
+	for n, opt := range strings.Split(line[i+1:], ",") {
+		name, value := strings.TrimSpace(opt), ""
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, value = strings.TrimSpace(name[:eq]), strings.TrimSpace(name[eq+1:])
+		}
+		switch strings.ToLower(name) {
+		case "response":
+			if !responseKinds[strings.ToLower(value)] {
+				return "", opts, fmt.Errorf("unknown response %q, expected one of page, image, script, style or nocontent", value)
+			}
+			opts.response = strings.ToLower(value)
+		case "redirect":
+			if !surrogates.Exists(value) {
+				return "", opts, fmt.Errorf("unknown redirect %q, expected one of %s", value,
+					strings.Join(surrogates.Names(), ", "))
+			}
+			opts.redirect = value
+		default:
+			if n == 0 {
+				// not options, just a regex with a $ in it
+				return line, opts, nil
+			}
+			return "", opts, fmt.Errorf("unknown rule option %q", opt)
+		}
+	}
+	return line[:i], opts, nil
+}
+
+// Whether this is a ||host rule matching hostname (no port) or one of its
+// parent domains.
+func (r *Rule) MatchesHost(hostname string) bool {
+	if len(r.Host) == 0 {
+		return false
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	return hostname == r.Host || strings.HasSuffix(hostname, "."+r.Host)
+}
+
+// Returns the first ||host rule in the list that matches hostname, or nil.
+func FirstHostMatch(list []*Rule, hostname string) *Rule {
+	for _, r := range list {
+		if r.MatchesHost(hostname) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Returns the first rule in the list that matches the given url, or nil if
+// none match.
+func FirstMatch(list []*Rule, url string) *Rule {
+	for _, r := range list {
+		if r.MatchString(url) {
+			return r
+		}
+	}
+	return nil
+}
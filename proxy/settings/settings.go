@@ -3,14 +3,107 @@ package settings
 // Proxy settings are changed via local webserver pages
 
 import (
-	"fmt"
+	"embed"
+	"encoding/json"
+	"html/template"
+	"log"
 	"net/http"
+	"strings"
+
+	"github.com/jcuga/proxyblock/proxy/cosmetic"
+	"github.com/jcuga/proxyblock/proxy/rules"
+	"github.com/jcuga/proxyblock/utils"
+)
+
+const (
+	RulesReportUrl = "/proxy-settings/rules-report"
+	CosmeticUrl    = "/proxy-settings/element-hiding"
+)
+
+var (
+	//go:embed templates
+	templates embed.FS
+
+	pageTemplates = template.Must(template.ParseFS(templates, "templates/*.html"))
 )
 
 func ProxySettingsHandler(w http.ResponseWriter, r *http.Request) {
-	// Don't cache response:
+	setNoCacheHeaders(w)
+	data := struct{ RulesReportUrl, CosmeticUrl string }{RulesReportUrl, CosmeticUrl}
+	if err := pageTemplates.ExecuteTemplate(w, "settings.html", data); err != nil {
+		log.Printf("ERROR: failed to render settings.  error: %q", err)
+	}
+}
+
+// Serves a report of which rules are unused, shadowed or duplicated based on
+// replaying the request history against the current rules.
+func GetRulesReportHandler(getReport func() *rules.Report) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setNoCacheHeaders(w)
+		if err := pageTemplates.ExecuteTemplate(w, "rules-report.html", getReport()); err != nil {
+			log.Printf("ERROR: failed to render rules report.  error: %q", err)
+		}
+	}
+}
+
+// Lists the element hiding rules and lets the user add and remove their own.
+// Changes are POSTed back here with action=add (rule) or action=remove
+// (pattern).  Scripts that ask for JSON (the page controls' element picker)
+// get {"error": ...} back instead of the page.
+func GetCosmeticHandler(filter *cosmetic.Filter) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setNoCacheHeaders(w)
+		data := struct {
+			FileRules, UserRules []*rules.CosmeticRule
+			Rule, Error          string
+		}{}
+		if r.Method == http.MethodPost {
+			if !utils.IsSameOrigin(r) {
+				http.Error(w, "403 Forbidden.", http.StatusForbidden)
+				return
+			}
+			var err error
+			switch r.FormValue("action") {
+			case "add":
+				err = filter.Add(r.FormValue("rule"))
+			case "remove":
+				err = filter.Remove(r.FormValue("pattern"))
+			}
+			if strings.Contains(r.Header.Get("Accept"), "application/json") {
+				writeJsonResult(w, err)
+				return
+			}
+			if err == nil {
+				http.Redirect(w, r, CosmeticUrl, http.StatusSeeOther)
+				return
+			}
+			// show the form again with what was typed
+			data.Rule, data.Error = r.FormValue("rule"), err.Error()
+		}
+		data.FileRules, data.UserRules = filter.Rules()
+		if err := pageTemplates.ExecuteTemplate(w, "element-hiding.html", data); err != nil {
+			log.Printf("ERROR: failed to render element hiding rules.  error: %q", err)
+		}
+	}
+}
+
+func writeJsonResult(w http.ResponseWriter, err error) {
+	result := struct {
+		Error string `json:"error,omitempty"`
+	}{}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		result.Error = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("ERROR: failed to write result.  error: %q", err)
+	}
+}
+
+// Don't cache response:
+func setNoCacheHeaders(w http.ResponseWriter) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate") // HTTP 1.1.
 	w.Header().Set("Pragma", "no-cache")                                   // HTTP 1.0.
 	w.Header().Set("Expires", "0")                                         // Proxies.
-	fmt.Fprintf(w, `<h1>ProxyBlock Settings</h1><h3>Todo</h3>`)
 }
@@ -0,0 +1,98 @@
+package settings
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+
+	"github.com/jcuga/proxyblock/proxy/cosmetic"
+	"github.com/jcuga/proxyblock/proxy/rules"
+)
+
+// What a crafted url or rule could try to sneak into a page
+var maliciousStrings = []string{
+	`"><script>alert(1)</script>`,
+	`'><img src=x onerror=alert(1)>`,
+	`</script><script>alert(1)</script>`,
+	`javascript:alert(1)`,
+}
+
+var urlAttrs = map[string]bool{"href": true, "src": true, "action": true, "formaction": true}
+
+// Fail if page has script elements, event handler attributes or javascript:
+// links that the template didn't put there itself.  Returns the page's text
+// and attribute values.
+func checkPage(t *testing.T, page string) string {
+	t.Helper()
+	var text strings.Builder
+	z := html.NewTokenizer(strings.NewReader(page))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return text.String()
+		case html.TextToken:
+			text.Write(z.Text())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if tok.Data == "script" || tok.Data == "img" {
+				t.Errorf("injected <%s> in page:\n%s", tok.Data, page)
+			}
+			for _, attr := range tok.Attr {
+				if strings.HasPrefix(attr.Key, "on") {
+					t.Errorf("injected %s attribute in page:\n%s", attr.Key, page)
+				}
+				if urlAttrs[attr.Key] && strings.HasPrefix(strings.ToLower(strings.TrimSpace(attr.Val)), "javascript:") {
+					t.Errorf("javascript: url in %s attribute:\n%s", attr.Key, page)
+				}
+				text.WriteString(attr.Val)
+			}
+		}
+	}
+}
+
+func TestRulesReportEscapesRules(t *testing.T) {
+	for _, bad := range maliciousStrings {
+		t.Run(bad, func(t *testing.T) {
+			rule := &rules.Rule{Pattern: bad, File: bad, Line: 1}
+			stats := &rules.RuleStats{Rule: rule, List: "blacklist", ShadowedBy: []*rules.Rule{rule}, DuplicateOf: rule}
+			report := &rules.Report{Rules: []*rules.RuleStats{stats}}
+			rec := httptest.NewRecorder()
+			GetRulesReportHandler(func() *rules.Report { return report })(rec, httptest.NewRequest("GET", RulesReportUrl, nil))
+			if text := checkPage(t, rec.Body.String()); !strings.Contains(text, bad) {
+				t.Errorf("rule %q not shown as text:\n%s", bad, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestElementHidingEscapesRules(t *testing.T) {
+	for _, bad := range maliciousStrings {
+		t.Run(bad, func(t *testing.T) {
+			filter := cosmetic.New([]*rules.CosmeticRule{{Pattern: bad, File: bad, Line: 1}})
+			handler := GetCosmeticHandler(filter)
+
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("GET", CosmeticUrl, nil))
+			if text := checkPage(t, rec.Body.String()); !strings.Contains(text, bad) {
+				t.Errorf("file rule %q not shown as text:\n%s", bad, rec.Body.String())
+			}
+
+			// a bad rule gets echoed back in the form, along with the error
+			form := url.Values{"action": {"add"}, "rule": {bad}}
+			req := httptest.NewRequest("POST", CosmeticUrl, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec = httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("adding %q: status = %d, want the form shown again", bad, rec.Code)
+			}
+			if text := checkPage(t, rec.Body.String()); !strings.Contains(text, bad) {
+				t.Errorf("rule %q not echoed back as text:\n%s", bad, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package socks
+
+// A minimal SOCKS5 server (RFC 1928: CONNECT only, no authentication) for
+// tools that don't speak HTTP proxy.  Connections to blocked hosts are refused
+// during the SOCKS handshake.  Everything else is handed to the http proxy as
+// a CONNECT tunnel, so http and https streams go thru the same filtering and
+// page control injection as requests made to the http proxy directly.
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Set on the CONNECT requests handed to the http proxy so it knows what kind
+// of stream is inside the tunnel.  Only trusted on requests that came thru
+// the SOCKS listener, see StreamType.
+const (
+	StreamTypeHeader = "X-Proxyblock-Socks-Stream"
+	StreamTls        = "tls"
+	StreamHttp       = "http"
+	// anything else, tunneled as-is
+	StreamRaw = "raw"
+)
+
+const (
+	socksVersion = 0x05
+
+	methodNoAuth       = 0x00
+	methodNoAcceptable = 0xFF
+
+	cmdConnect = 0x01
+
+	addrIPv4   = 0x01
+	addrDomain = 0x03
+	addrIPv6   = 0x04
+
+	replySucceeded        = 0x00
+	replyNotAllowed       = 0x02
+	replyCmdNotSupported  = 0x07
+	replyAddrNotSupported = 0x08
+)
+
+// Marks the requests the http proxy gets thru our in-process tunnels
+type tunnelKey struct{}
+
+// How long to wait for the client to send something before assuming the
+// protocol is one where the server talks first.
+var sniffTimeout = 2 * time.Second
+
+type Server struct {
+	addr string
+	// Called with the destination host (no port), returns false to refuse
+	// the connection.
+	allowHost func(host string) bool
+	// The http proxy that tunnels are handed to
+	proxyServer *http.Server
+	tunnels     *pipeListener
+}
+
+func NewServer(addr string, proxyHandler http.Handler, allowHost func(host string) bool) *Server {
+	return &Server{
+		addr:      addr,
+		allowHost: allowHost,
+		proxyServer: &http.Server{
+			Handler: proxyHandler,
+			ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+				return context.WithValue(ctx, tunnelKey{}, true)
+			},
+		},
+		tunnels: newPipeListener(),
+	}
+}
+
+// The kind of stream inside a CONNECT tunnel handed over by the SOCKS
+// listener.  Empty for requests that didn't come from it, whatever headers
+// they carry.
+func StreamType(req *http.Request) string {
+	if tunnel, _ := req.Context().Value(tunnelKey{}).(bool); !tunnel {
+		return ""
+	}
+	return req.Header.Get(StreamTypeHeader)
+}
+
+// Start serving in the background.
+func (s *Server) Serve() {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		log.Printf("ERROR: failed to start SOCKS5 listener.  error: %q", err)
+		return
+	}
+	log.Printf("Starting SOCKS5 proxy on: %s", s.addr)
+	go s.proxyServer.Serve(s.tunnels)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("ERROR: SOCKS5 accept failed.  error: %q", err)
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if err := negotiateAuth(reader, conn); err != nil {
+		log.Printf("SOCKS5 handshake failed: %v", err)
+		return
+	}
+	host, port, reply, err := readConnectRequest(reader)
+	if err != nil {
+		log.Printf("SOCKS5 request failed: %v", err)
+		writeReply(conn, reply)
+		return
+	}
+	if !s.allowHost(host) {
+		writeReply(conn, replyNotAllowed)
+		return
+	}
+	if err := writeReply(conn, replySucceeded); err != nil {
+		return
+	}
+	s.tunnel(conn, reader, net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// Hand the client's stream to the http proxy via CONNECT and shuttle bytes
+// both ways until either side is done.
+func (s *Server) tunnel(conn net.Conn, reader *bufio.Reader, hostPort string) {
+	streamType := sniff(conn, reader)
+	clientEnd, proxyEnd := net.Pipe()
+	defer clientEnd.Close()
+	if err := s.tunnels.push(proxyEnd); err != nil {
+		return
+	}
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Host: hostPort},
+		Host:   hostPort,
+		Header: http.Header{StreamTypeHeader: []string{streamType}},
+	}
+	if err := connectReq.Write(clientEnd); err != nil {
+		log.Printf("ERROR: SOCKS5 tunnel to %s failed.  error: %q", hostPort, err)
+		return
+	}
+	// Nothing comes after the CONNECT response until we start talking thru
+	// the tunnel, so it's safe to throw away the buffered reader.
+	resp, err := http.ReadResponse(bufio.NewReader(clientEnd), connectReq)
+	if err != nil {
+		log.Printf("ERROR: SOCKS5 tunnel to %s failed.  error: %q", hostPort, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("SOCKS5 tunnel to %s refused: %s", hostPort, resp.Status)
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(clientEnd, reader)
+		clientEnd.Close()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, clientEnd)
+		conn.Close()
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Guess what kind of stream the client is about to send from its first byte
+func sniff(conn net.Conn, reader *bufio.Reader) string {
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	first, err := reader.Peek(1)
+	if err != nil {
+		return StreamRaw
+	}
+	switch {
+	case first[0] == 0x16:
+		// TLS handshake record
+		return StreamTls
+	case first[0] >= 'A' && first[0] <= 'Z':
+		// Looks like an http method
+		return StreamHttp
+	}
+	return StreamRaw
+}
+
+func negotiateAuth(reader *bufio.Reader, conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return err
+	}
+	for _, m := range methods {
+		if m == methodNoAuth {
+			_, err := conn.Write([]byte{socksVersion, methodNoAuth})
+			return err
+		}
+	}
+	conn.Write([]byte{socksVersion, methodNoAcceptable})
+	return errors.New("client doesn't support no-auth")
+}
+
+// Returns the destination of a CONNECT request, or the reply code to send
+// along with the error.
+func readConnectRequest(reader *bufio.Reader) (string, int, byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", 0, replyCmdNotSupported, err
+	}
+	if header[0] != socksVersion {
+		return "", 0, replyCmdNotSupported, fmt.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+	if header[1] != cmdConnect {
+		return "", 0, replyCmdNotSupported, fmt.Errorf("unsupported command: %d", header[1])
+	}
+	var host string
+	switch header[3] {
+	case addrIPv4, addrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if header[3] == addrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", 0, replyAddrNotSupported, err
+		}
+		host = net.IP(ip).String()
+	case addrDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", 0, replyAddrNotSupported, err
+		}
+		domain := make([]byte, length)
+		if _, err := io.ReadFull(reader, domain); err != nil {
+			return "", 0, replyAddrNotSupported, err
+		}
+		host = string(domain)
+	default:
+		return "", 0, replyAddrNotSupported, fmt.Errorf("unsupported address type: %d", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", 0, replyAddrNotSupported, err
+	}
+	return host, int(binary.BigEndian.Uint16(port)), replySucceeded, nil
+}
+
+func writeReply(conn net.Conn, reply byte) error {
+	// bound address is always reported as 0.0.0.0:0
+	_, err := conn.Write([]byte{socksVersion, reply, 0x00, addrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
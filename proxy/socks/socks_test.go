@@ -0,0 +1,176 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// A SOCKS5 CONNECT request for a domain
+func connectRequest(host string, port int) []byte {
+	req := []byte{socksVersion, cmdConnect, 0x00, addrDomain, byte(len(host))}
+	req = append(req, host...)
+	return append(req, byte(port>>8), byte(port))
+}
+
+// Serve one SOCKS connection and return the client's end of it
+func startServer(t *testing.T, s *Server) net.Conn {
+	client, server := net.Pipe()
+	go s.handle(server)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+func readReply(t *testing.T, conn net.Conn) byte {
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	return reply[1]
+}
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		greeting []byte
+		want     []byte
+	}{
+		{"no auth", []byte{socksVersion, 1, methodNoAuth}, []byte{socksVersion, methodNoAuth}},
+		{"no auth among others", []byte{socksVersion, 2, 0x02, methodNoAuth}, []byte{socksVersion, methodNoAuth}},
+		{"auth only", []byte{socksVersion, 1, 0x02}, []byte{socksVersion, methodNoAcceptable}},
+	}
+	for _, test := range tests {
+		s := NewServer("", http.NotFoundHandler(), func(string) bool { return true })
+		conn := startServer(t, s)
+		conn.Write(test.greeting)
+		got := make([]byte, 2)
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Errorf("%s: reading method: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadConnectRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       []byte
+		wantHost  string
+		wantPort  int
+		wantReply byte
+	}{
+		{"domain", connectRequest("example.com", 443), "example.com", 443, replySucceeded},
+		{"ipv4", []byte{socksVersion, cmdConnect, 0, addrIPv4, 10, 0, 0, 1, 0, 80}, "10.0.0.1", 80, replySucceeded},
+		{"ipv6", append([]byte{socksVersion, cmdConnect, 0, addrIPv6}, append(net.ParseIP("::1"), 0, 22)...),
+			"::1", 22, replySucceeded},
+		{"bind", []byte{socksVersion, 0x02, 0, addrIPv4, 10, 0, 0, 1, 0, 80}, "", 0, replyCmdNotSupported},
+		{"bad address type", []byte{socksVersion, cmdConnect, 0, 0x09, 0, 80}, "", 0, replyAddrNotSupported},
+		{"truncated", []byte{socksVersion, cmdConnect, 0, addrDomain, 20, 'a'}, "", 0, replyAddrNotSupported},
+	}
+	for _, test := range tests {
+		host, port, reply, err := readConnectRequest(bufio.NewReader(bytes.NewReader(test.req)))
+		if reply != test.wantReply || (err == nil) != (reply == replySucceeded) {
+			t.Errorf("%s: got reply %d (error %v), want %d", test.name, reply, err, test.wantReply)
+			continue
+		}
+		if host != test.wantHost || port != test.wantPort {
+			t.Errorf("%s: got %s:%d, want %s:%d", test.name, host, port, test.wantHost, test.wantPort)
+		}
+	}
+}
+
+func TestBlockedHostRefused(t *testing.T) {
+	var asked string
+	s := NewServer("", http.NotFoundHandler(), func(host string) bool {
+		asked = host
+		return host != "ads.example.com"
+	})
+	conn := startServer(t, s)
+	conn.Write([]byte{socksVersion, 1, methodNoAuth})
+	io.ReadFull(conn, make([]byte, 2))
+	conn.Write(connectRequest("ads.example.com", 443))
+	if reply := readReply(t, conn); reply != replyNotAllowed {
+		t.Errorf("got reply %d, want %d", reply, replyNotAllowed)
+	}
+	if asked != "ads.example.com" {
+		t.Errorf("allowHost got %q, want ads.example.com", asked)
+	}
+}
+
+// Allowed connections become CONNECT requests to the http proxy, marked with
+// the kind of stream the client sent.
+func TestTunnel(t *testing.T) {
+	tests := []struct {
+		name  string
+		first []byte
+		want  string
+	}{
+		{"tls", []byte{0x16, 0x03, 0x01}, StreamTls},
+		{"http", []byte("GET / HTTP/1.1\r\n"), StreamHttp},
+		{"raw", []byte{0x00, 0x01}, StreamRaw},
+	}
+	for _, test := range tests {
+		gotType := make(chan string, 1)
+		gotHost := make(chan string, 1)
+		proxy := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			gotType <- StreamType(req)
+			gotHost <- req.Host
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("hijack: %v", err)
+				return
+			}
+			defer conn.Close()
+			conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+			// echo back what the client sent
+			first := make([]byte, len(test.first))
+			io.ReadFull(buf, first)
+			conn.Write(first)
+		})
+		s := NewServer("", proxy, func(string) bool { return true })
+		go s.proxyServer.Serve(s.tunnels)
+		conn := startServer(t, s)
+		conn.Write([]byte{socksVersion, 1, methodNoAuth})
+		io.ReadFull(conn, make([]byte, 2))
+		conn.Write(connectRequest("example.com", 8443))
+		if reply := readReply(t, conn); reply != replySucceeded {
+			t.Errorf("%s: got reply %d, want %d", test.name, reply, replySucceeded)
+			s.proxyServer.Close()
+			continue
+		}
+		conn.Write(test.first)
+		echoed := make([]byte, len(test.first))
+		if _, err := io.ReadFull(conn, echoed); err != nil || !bytes.Equal(echoed, test.first) {
+			t.Errorf("%s: echoed %q (error %v), want %q", test.name, echoed, err, test.first)
+		}
+		if got := <-gotType; got != test.want {
+			t.Errorf("%s: stream type %q, want %q", test.name, got, test.want)
+		}
+		if got := <-gotHost; got != "example.com:8443" {
+			t.Errorf("%s: CONNECT to %q, want example.com:8443", test.name, got)
+		}
+		s.proxyServer.Close()
+	}
+}
+
+// The header is only believed on requests that came thru the tunnels
+func TestStreamType(t *testing.T) {
+	req, _ := http.NewRequest("CONNECT", "http://example.com:443", nil)
+	req.Header.Set(StreamTypeHeader, StreamHttp)
+	if got := StreamType(req); got != "" {
+		t.Errorf("outside a tunnel got %q, want \"\"", got)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), tunnelKey{}, true))
+	if got := StreamType(req); got != StreamHttp {
+		t.Errorf("inside a tunnel got %q, want %q", got, StreamHttp)
+	}
+}
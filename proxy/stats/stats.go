@@ -0,0 +1,127 @@
+package stats
+
+// Running totals of what the proxy has done since it started.  These are
+// served as JSON by the control server so they can be queried from the shell.
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jcuga/proxyblock/proxy/rules"
+)
+
+const (
+	StatsUrl = "/stats"
+	// How many pages that didn't get page controls are remembered
+	maxInjectionFailures = 50
+)
+
+type RuleHits struct {
+	Rule    string `json:"rule"`
+	Pattern string `json:"pattern"`
+	Hits    int    `json:"hits"`
+}
+
+// A page the page controls couldn't be injected into
+type InjectionFailure struct {
+	Time   time.Time `json:"time"`
+	Url    string    `json:"url"`
+	Reason string    `json:"reason"`
+}
+
+// JSON representation served at StatsUrl
+type Snapshot struct {
+	Started       time.Time      `json:"started"`
+	UptimeSeconds int64          `json:"uptime_seconds"`
+	Requests      map[string]int `json:"requests"`
+	RuleHits      []RuleHits     `json:"rule_hits"`
+	Injected      int            `json:"injected"`
+	NotInjected   int            `json:"not_injected"`
+	// Most recent first
+	InjectionFailures []InjectionFailure `json:"injection_failures"`
+}
+
+type Stats struct {
+	mu                sync.Mutex
+	started           time.Time
+	requests          map[string]int
+	ruleHits          map[*rules.Rule]int
+	injected          int
+	notInjected       int
+	injectionFailures []InjectionFailure
+}
+
+func New() *Stats {
+	return &Stats{
+		started:  time.Now(),
+		requests: make(map[string]int),
+		ruleHits: make(map[*rules.Rule]int),
+	}
+}
+
+func (s *Stats) Record(d rules.Decision) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[d.Action]++
+	if d.Rule != nil {
+		s.ruleHits[d.Rule]++
+	}
+}
+
+// Record whether the page controls made it into a page, err saying why not
+func (s *Stats) RecordInjection(url string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.injected++
+		return
+	}
+	s.notInjected++
+	s.injectionFailures = append(s.injectionFailures, InjectionFailure{time.Now(), url, err.Error()})
+	if len(s.injectionFailures) > maxInjectionFailures {
+		s.injectionFailures = s.injectionFailures[1:]
+	}
+}
+
+func (s *Stats) Snapshot() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := Snapshot{
+		Started:       s.started,
+		UptimeSeconds: int64(time.Since(s.started) / time.Second),
+		Requests:      make(map[string]int, len(s.requests)),
+		RuleHits:      make([]RuleHits, 0, len(s.ruleHits)),
+		Injected:      s.injected,
+		NotInjected:   s.notInjected,
+	}
+	snap.InjectionFailures = make([]InjectionFailure, len(s.injectionFailures))
+	for i, f := range s.injectionFailures {
+		snap.InjectionFailures[len(s.injectionFailures)-1-i] = f
+	}
+	for action, count := range s.requests {
+		snap.Requests[action] = count
+	}
+	for r, hits := range s.ruleHits {
+		snap.RuleHits = append(snap.RuleHits, RuleHits{Rule: r.Location(), Pattern: r.Pattern, Hits: hits})
+	}
+	// most used rules first
+	sort.Slice(snap.RuleHits, func(i, j int) bool {
+		if snap.RuleHits[i].Hits != snap.RuleHits[j].Hits {
+			return snap.RuleHits[i].Hits > snap.RuleHits[j].Hits
+		}
+		return snap.RuleHits[i].Rule < snap.RuleHits[j].Rule
+	})
+	return snap
+}
+
+func (s *Stats) Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Snapshot()); err != nil {
+		log.Printf("ERROR: failed to write stats.  error: %q", err)
+	}
+}
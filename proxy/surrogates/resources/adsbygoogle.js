@@ -0,0 +1,23 @@
+// Stand-in for pagead2.googlesyndication.com/pagead/js/adsbygoogle.js: takes
+// ad requests and does nothing with them.
+(function () {
+    'use strict';
+    var queued = window.adsbygoogle;
+    window.adsbygoogle = {
+        loaded: true,
+        push: function () {
+            return 0;
+        }
+    };
+    if (Array.isArray(queued)) {
+        queued.forEach(function (item) {
+            if (item instanceof Object && item.params instanceof Object &&
+                typeof item.params.google_ad_load_done === 'function') {
+                try {
+                    item.params.google_ad_load_done();
+                } catch (e) {
+                }
+            }
+        });
+    }
+})();
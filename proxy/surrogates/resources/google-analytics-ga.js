@@ -0,0 +1,76 @@
+// Stand-in for www.google-analytics.com/ga.js, the old _gaq api.
+(function () {
+    'use strict';
+    var noop = function () {};
+    var tracker = {};
+    [
+        '_addIgnoredOrganic', '_addIgnoredRef', '_addItem', '_addOrganic', '_addTrans',
+        '_clearIgnoredOrganic', '_clearIgnoredRef', '_clearOrganic', '_cookiePathCopy',
+        '_deleteCustomVar', '_getName', '_getVersion', '_initData', '_setAccount',
+        '_setAllowLinker', '_setCampaignCookieTimeout', '_setClientInfo', '_setCookiePath',
+        '_setCookieTimeout', '_setCustomVar', '_setDetectFlash', '_setDetectTitle',
+        '_setDomainName', '_setLocalGifPath', '_setLocalRemoteServerMode', '_setLocalServerMode',
+        '_setReferrerOverride', '_setRemoteServerMode', '_setSampleRate', '_setSessionTimeout',
+        '_setSiteSpeedSampleRate', '_setSessionCookieTimeout', '_setVar', '_setVisitorCookieTimeout',
+        '_trackEvent', '_trackPageLoadTime', '_trackPageview', '_trackSocial', '_trackTiming',
+        '_trackTrans', '_visitCode'
+    ].forEach(function (name) {
+        tracker[name] = noop;
+    });
+    tracker._getLinkerUrl = function (url) {
+        return url;
+    };
+    tracker._link = function (url) {
+        if (typeof url === 'string') {
+            window.location.href = url;
+        }
+    };
+    tracker._linkByPost = noop;
+    var gat = {
+        _anonymizeIp: noop,
+        _createTracker: function () {
+            return tracker;
+        },
+        _forceSSL: noop,
+        _getPlayerTracker: function () {
+            return tracker;
+        },
+        _getTracker: function () {
+            return tracker;
+        },
+        _getTrackerByName: function () {
+            return tracker;
+        },
+        _getTrackers: function () {
+            return [tracker];
+        }
+    };
+    var run = function (command) {
+        if (typeof command === 'function') {
+            try {
+                command();
+            } catch (e) {
+            }
+        }
+    };
+    var gaq = {
+        _createAsyncTracker: function () {
+            return tracker;
+        },
+        _getAsyncTracker: function () {
+            return tracker;
+        },
+        push: function () {
+            for (var i = 0; i < arguments.length; i++) {
+                run(arguments[i]);
+            }
+            return 0;
+        }
+    };
+    var queued = window._gaq;
+    window._gat = gat;
+    window._gaq = gaq;
+    if (Array.isArray(queued)) {
+        gaq.push.apply(gaq, queued);
+    }
+})();
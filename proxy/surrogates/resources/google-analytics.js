@@ -0,0 +1,49 @@
+// Stand-in for www.google-analytics.com/analytics.js: keeps ga() calls from
+// throwing and runs hitCallbacks so pages waiting on them carry on.
+(function () {
+    'use strict';
+    var noop = function () {};
+    var Tracker = function () {};
+    Tracker.prototype.get = noop;
+    Tracker.prototype.set = noop;
+    Tracker.prototype.send = noop;
+    var runCallback = function (args) {
+        var last = args[args.length - 1];
+        if (last instanceof Object && typeof last.hitCallback === 'function') {
+            try {
+                last.hitCallback();
+            } catch (e) {
+            }
+        }
+    };
+    var ga = function () {
+        var args = Array.prototype.slice.call(arguments);
+        if (typeof args[0] === 'function') {
+            try {
+                args[0](new Tracker());
+            } catch (e) {
+            }
+            return;
+        }
+        runCallback(args);
+    };
+    ga.create = function () {
+        return new Tracker();
+    };
+    ga.getByName = function () {
+        return new Tracker();
+    };
+    ga.getAll = function () {
+        return [new Tracker()];
+    };
+    ga.remove = noop;
+    ga.loaded = true;
+    var name = window.GoogleAnalyticsObject || 'ga';
+    var queued = window[name] && window[name].q;
+    window[name] = ga;
+    if (Array.isArray(queued)) {
+        for (var i = 0; i < queued.length; i++) {
+            ga.apply(null, queued[i]);
+        }
+    }
+})();
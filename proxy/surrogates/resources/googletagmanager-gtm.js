@@ -0,0 +1,30 @@
+// Stand-in for www.googletagmanager.com/gtm.js and gtag.js: accepts
+// dataLayer pushes and runs eventCallbacks so pages waiting on them carry on.
+(function () {
+    'use strict';
+    var runCallback = function (item) {
+        if (item instanceof Object && typeof item.eventCallback === 'function') {
+            try {
+                setTimeout(item.eventCallback, 1);
+            } catch (e) {
+            }
+        }
+    };
+    var dataLayer = window.dataLayer;
+    if (!Array.isArray(dataLayer)) {
+        dataLayer = window.dataLayer = [];
+    }
+    dataLayer.forEach(runCallback);
+    dataLayer.push = function () {
+        for (var i = 0; i < arguments.length; i++) {
+            runCallback(arguments[i]);
+        }
+        return Array.prototype.push.apply(this, arguments);
+    };
+    window.google_tag_manager = window.google_tag_manager || {};
+    if (typeof window.gtag !== 'function') {
+        window.gtag = function () {
+            dataLayer.push(arguments);
+        };
+    }
+})();
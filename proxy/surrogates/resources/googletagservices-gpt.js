@@ -0,0 +1,147 @@
+// Stand-in for www.googletagservices.com/tag/js/gpt.js: the googletag api
+// without any ads, so code queued with googletag.cmd.push still runs.
+(function () {
+    'use strict';
+    var noop = function () {};
+    var returnThis = function () {
+        return this;
+    };
+    var returnNull = function () {
+        return null;
+    };
+    var returnEmpty = function () {
+        return [];
+    };
+    var Slot = function (path, id) {
+        this.path = path || '';
+        this.id = id || '';
+    };
+    Slot.prototype = {
+        addService: returnThis,
+        clearCategoryExclusions: returnThis,
+        clearTargeting: returnThis,
+        defineSizeMapping: returnThis,
+        get: returnNull,
+        getAdUnitPath: function () {
+            return this.path;
+        },
+        getAttributeKeys: returnEmpty,
+        getCategoryExclusions: returnEmpty,
+        getDomId: function () {
+            return this.id;
+        },
+        getResponseInformation: returnNull,
+        getSlotElementId: function () {
+            return this.id;
+        },
+        getSlotId: returnThis,
+        getTargeting: returnEmpty,
+        getTargetingKeys: returnEmpty,
+        set: returnThis,
+        setCategoryExclusion: returnThis,
+        setClickUrl: returnThis,
+        setCollapseEmptyDiv: returnThis,
+        setConfig: returnThis,
+        setTargeting: returnThis,
+        updateTargetingFromMap: returnThis
+    };
+    var pubads = {
+        addEventListener: returnThis,
+        clear: noop,
+        clearCategoryExclusions: returnThis,
+        clearTagForChildDirectedTreatment: returnThis,
+        clearTargeting: returnThis,
+        collapseEmptyDivs: noop,
+        defineOutOfPagePassback: function () {
+            return new Slot();
+        },
+        definePassback: function () {
+            return new Slot();
+        },
+        disableInitialLoad: noop,
+        display: noop,
+        enableAsyncRendering: noop,
+        enableLazyLoad: noop,
+        enableSingleRequest: noop,
+        enableSyncRendering: noop,
+        enableVideoAds: noop,
+        get: returnNull,
+        getAttributeKeys: returnEmpty,
+        getTargeting: returnEmpty,
+        getTargetingKeys: returnEmpty,
+        getSlots: returnEmpty,
+        isInitialLoadDisabled: function () {
+            return true;
+        },
+        refresh: noop,
+        removeEventListener: noop,
+        set: returnThis,
+        setCategoryExclusion: returnThis,
+        setCentering: noop,
+        setCookieOptions: returnThis,
+        setForceSafeFrame: returnThis,
+        setLocation: returnThis,
+        setPrivacySettings: returnThis,
+        setPublisherProvidedId: returnThis,
+        setRequestNonPersonalizedAds: returnThis,
+        setSafeFrameConfig: returnThis,
+        setTagForChildDirectedTreatment: returnThis,
+        setTargeting: returnThis,
+        setVideoContent: returnThis,
+        updateCorrelator: noop
+    };
+    var run = function (fn) {
+        if (typeof fn === 'function') {
+            try {
+                fn.call(window);
+            } catch (e) {
+            }
+        }
+    };
+    var googletag = window.googletag || {};
+    var queued = googletag.cmd || [];
+    googletag.apiReady = true;
+    googletag.pubadsReady = true;
+    googletag.cmd = {
+        push: function () {
+            for (var i = 0; i < arguments.length; i++) {
+                run(arguments[i]);
+            }
+            return 0;
+        }
+    };
+    googletag.companionAds = function () {
+        return {addEventListener: returnThis, enableSyncLoading: noop, setRefreshUnfilledSlots: noop};
+    };
+    googletag.content = function () {
+        return {addEventListener: returnThis, setContent: noop};
+    };
+    googletag.defineOutOfPageSlot = function (path, id) {
+        return new Slot(path, id);
+    };
+    googletag.defineSlot = function (path, size, id) {
+        return new Slot(path, id);
+    };
+    googletag.destroySlots = noop;
+    googletag.disablePublisherConsole = noop;
+    googletag.display = noop;
+    googletag.enableServices = noop;
+    googletag.getVersion = function () {
+        return '';
+    };
+    googletag.openConsole = noop;
+    googletag.pubads = function () {
+        return pubads;
+    };
+    googletag.setAdIframeTitle = noop;
+    googletag.sizeMapping = function () {
+        return {
+            addSize: returnThis,
+            build: returnEmpty
+        };
+    };
+    window.googletag = googletag;
+    for (var i = 0; i < queued.length; i++) {
+        run(queued[i]);
+    }
+})();
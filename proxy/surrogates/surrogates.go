@@ -0,0 +1,60 @@
+package surrogates
+
+// Inert stand-ins for common tracker and ad scripts.  Blocking something like
+// analytics.js outright breaks pages that call into it (ga(), _gaq.push), so a
+// blacklist rule can name one of these to be served in its place instead, see
+// the $redirect rule option.  They're built into the binary and only provide
+// the script's api, doing nothing with whatever is passed to it.
+
+import (
+	"embed"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+var (
+	//go:embed resources
+	resources embed.FS
+)
+
+// The surrogate called name (its filename, ie google-analytics.js), and its
+// content type.  ok is false if there's no such surrogate.
+func Get(name string) (contentType string, body []byte, ok bool) {
+	if len(name) == 0 || path.Base(name) != name {
+		return "", nil, false
+	}
+	body, err := resources.ReadFile("resources/" + name)
+	if err != nil {
+		return "", nil, false
+	}
+	switch path.Ext(name) {
+	case ".js":
+		contentType = "text/javascript; charset=utf-8"
+	case ".css":
+		contentType = "text/css; charset=utf-8"
+	default:
+		contentType = "application/octet-stream"
+	}
+	return contentType, body, true
+}
+
+// Whether there's a surrogate called name
+func Exists(name string) bool {
+	_, _, ok := Get(name)
+	return ok
+}
+
+// Names of all the surrogates, sorted
+func Names() []string {
+	entries, err := fs.ReadDir(resources, "resources")
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
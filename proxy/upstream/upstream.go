@@ -0,0 +1,190 @@
+package upstream
+
+// Routes outbound connections through upstream proxies.  Each destination
+// host either goes direct, thru the default upstream, or thru the upstream of
+// the first route whose hosts match it.  Upstreams are HTTP proxies (plain
+// requests are forwarded, https tunnels use CONNECT) or SOCKS5 proxies, with
+// optional user:password credentials in the url.
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+
+	"github.com/jcuga/proxyblock/proxy/config"
+	"github.com/jcuga/proxyblock/utils"
+)
+
+// Use as a route's proxy to send matching hosts direct
+const Direct = "direct"
+
+var dialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+type route struct {
+	hosts utils.HostList
+	// nil for direct
+	proxyUrl *url.URL
+}
+
+type Router struct {
+	// nil for direct
+	defaultProxy *url.URL
+	noProxy      utils.HostList
+	routes       []route
+}
+
+func NewRouter(conf config.UpstreamConfig) (*Router, error) {
+	r := &Router{noProxy: utils.ParseHostList(conf.NoProxy)}
+	var err error
+	if r.defaultProxy, err = parseProxyUrl(conf.Default); err != nil {
+		return nil, err
+	}
+	for i, rc := range conf.Routes {
+		proxyUrl, err := parseProxyUrl(rc.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("upstream.routes[%d]: %v", i, err)
+		}
+		r.routes = append(r.routes, route{hosts: utils.ParseHostList(rc.Hosts), proxyUrl: proxyUrl})
+	}
+	return r, nil
+}
+
+// Whether any connections go thru an upstream proxy at all
+func (r *Router) Enabled() bool {
+	if r.defaultProxy != nil {
+		return true
+	}
+	for _, rt := range r.routes {
+		if rt.proxyUrl != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// The upstream proxy to use for host (with or without port), nil for direct.
+func (r *Router) ProxyFor(host string) *url.URL {
+	hostname := utils.StripPort(host)
+	for _, rt := range r.routes {
+		if rt.hosts.Matches(hostname) {
+			return rt.proxyUrl
+		}
+	}
+	if r.noProxy.Matches(hostname) {
+		return nil
+	}
+	return r.defaultProxy
+}
+
+// For use as http.Transport.Proxy
+func (r *Router) Proxy(req *http.Request) (*url.URL, error) {
+	return r.ProxyFor(req.URL.Host), nil
+}
+
+// Dial addr thru the appropriate upstream, for tunneled (CONNECT) traffic.
+func (r *Router) Dial(network, addr string) (net.Conn, error) {
+	proxyUrl := r.ProxyFor(addr)
+	if proxyUrl == nil {
+		return dialer.Dial(network, addr)
+	}
+	switch proxyUrl.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyUrl.User != nil {
+			password, _ := proxyUrl.User.Password()
+			auth = &proxy.Auth{User: proxyUrl.User.Username(), Password: password}
+		}
+		socksDialer, err := proxy.SOCKS5("tcp", proxyUrl.Host, auth, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return socksDialer.Dial(network, addr)
+	default:
+		return dialConnect(proxyUrl, addr)
+	}
+}
+
+// Open a tunnel to addr thru an HTTP proxy using CONNECT
+func dialConnect(proxyUrl *url.URL, addr string) (net.Conn, error) {
+	conn, err := dialer.Dial("tcp", proxyUrl.Host)
+	if err != nil {
+		return nil, err
+	}
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if auth := proxyAuthorization(proxyUrl); len(auth) > 0 {
+		connectReq.Header.Set("Proxy-Authorization", auth)
+	}
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s refused CONNECT to %s: %s", proxyUrl.Host, addr, resp.Status)
+	}
+	// Servers that talk first (ssh, smtp) can already have sent something
+	// along with the CONNECT response
+	if reader.Buffered() > 0 {
+		return &bufferedConn{conn, reader}, nil
+	}
+	return conn, nil
+}
+
+// A connection with some of what was read from it still in reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Basic auth header value for a proxy url with credentials, empty otherwise
+func proxyAuthorization(proxyUrl *url.URL) string {
+	if proxyUrl.User == nil {
+		return ""
+	}
+	password, _ := proxyUrl.User.Password()
+	creds := proxyUrl.User.Username() + ":" + password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(creds))
+}
+
+func parseProxyUrl(s string) (*url.URL, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 || strings.EqualFold(s, Direct) {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy %q: %v", s, err)
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid upstream proxy %q: scheme must be http, socks5 or socks5h", s)
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid upstream proxy %q: missing host", s)
+	}
+	return u, nil
+}
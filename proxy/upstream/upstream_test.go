@@ -0,0 +1,126 @@
+package upstream
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/jcuga/proxyblock/proxy/config"
+)
+
+func TestProxyFor(t *testing.T) {
+	r, err := NewRouter(config.UpstreamConfig{
+		Default: "http://corp-proxy:3128",
+		NoProxy: []string{"localhost", "intranet.example.com", "10.0.0.0/8"},
+		Routes: []config.UpstreamRoute{
+			{Hosts: []string{"tor.example.org"}, Proxy: "socks5h://127.0.0.1:9050"},
+			// routes come before no_proxy
+			{Hosts: []string{"wiki.intranet.example.com"}, Proxy: "http://wiki-proxy:8080"},
+			{Hosts: []string{".cdn.example.net"}, Proxy: "DIRECT"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Enabled() {
+		t.Errorf("Enabled() = false")
+	}
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"www.example.com:443", "http://corp-proxy:3128"},
+		{"tor.example.org:80", "socks5h://127.0.0.1:9050"},
+		{"wiki.intranet.example.com", "http://wiki-proxy:8080"},
+		{"intranet.example.com:443", ""},
+		{"mail.intranet.example.com", ""},
+		{"10.1.2.3:8080", ""},
+		{"img.cdn.example.net", ""},
+		{"cdn.example.net", "http://corp-proxy:3128"},
+	}
+	for _, test := range tests {
+		var got string
+		if u := r.ProxyFor(test.host); u != nil {
+			got = u.String()
+		}
+		if got != test.want {
+			t.Errorf("ProxyFor(%q) = %q, want %q", test.host, got, test.want)
+		}
+	}
+}
+
+func TestNewRouter(t *testing.T) {
+	r, err := NewRouter(config.UpstreamConfig{Routes: []config.UpstreamRoute{{Hosts: []string{"*"}, Proxy: "direct"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Enabled() {
+		t.Errorf("Enabled() = true without any upstream proxy")
+	}
+	for _, bad := range []string{"ftp://proxy:21", "http://", "proxy:3128", "http://%zz"} {
+		if _, err := NewRouter(config.UpstreamConfig{Default: bad}); err == nil {
+			t.Errorf("NewRouter with default %q didn't fail", bad)
+		}
+		if _, err := NewRouter(config.UpstreamConfig{Routes: []config.UpstreamRoute{{Hosts: []string{"*"}, Proxy: bad}}}); err == nil {
+			t.Errorf("NewRouter with route proxy %q didn't fail", bad)
+		}
+	}
+}
+
+// Tunnels thru http upstreams are opened with CONNECT, with the credentials
+// from the proxy url
+func TestDialConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	type connect struct {
+		target, auth string
+	}
+	connects := make(chan connect, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			connects <- connect{req.Host, req.Header.Get("Proxy-Authorization")}
+			if req.Method == http.MethodConnect && req.Host == "allowed.example.com:443" {
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+			} else {
+				conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	r, err := NewRouter(config.UpstreamConfig{Default: "http://user:secret@" + ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := r.Dial("tcp", "allowed.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v from the tunnel, want hello", buf, err)
+	}
+	conn.Close()
+	if got := <-connects; got.target != "allowed.example.com:443" || got.auth != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("CONNECT = %+v", got)
+	}
+
+	if conn, err := r.Dial("tcp", "refused.example.com:443"); err == nil {
+		conn.Close()
+		t.Errorf("Dial succeeded thru a refused CONNECT")
+	}
+	<-connects
+}
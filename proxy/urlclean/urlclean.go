@@ -0,0 +1,125 @@
+package urlclean
+
+// Takes tracking parameters (utm_source, fbclid, gclid...) out of urls before
+// they go anywhere.  Which parameters go is configurable, and sites can keep
+// some or all of them (see config.TrackingConfig).  Everything else about the
+// url, including the order and encoding of the parameters that stay, is left
+// as-is.
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jcuga/proxyblock/proxy/config"
+	"github.com/jcuga/proxyblock/proxy/vars"
+	"github.com/jcuga/proxyblock/utils"
+)
+
+type exception struct {
+	hosts utils.HostList
+	// empty for every parameter
+	params []string
+}
+
+type Cleaner struct {
+	params     []string
+	exceptions []exception
+}
+
+func NewCleaner(conf config.TrackingConfig) (*Cleaner, error) {
+	c := &Cleaner{}
+	var err error
+	if c.params, err = parseParams(conf.Params); err != nil {
+		return nil, fmt.Errorf("tracking_params.params: %v", err)
+	}
+	for i, ec := range conf.Exceptions {
+		params, err := parseParams(ec.Params)
+		if err != nil {
+			return nil, fmt.Errorf("tracking_params.exceptions[%d]: %v", i, err)
+		}
+		c.exceptions = append(c.exceptions, exception{hosts: utils.ParseHostList(ec.Hosts), params: params})
+	}
+	return c, nil
+}
+
+// The url without its tracking parameters, and the names of the parameters
+// that were removed.  Returns nil if there was nothing to remove.
+func (c *Cleaner) Clean(u *url.URL) (*url.URL, []string) {
+	if len(u.RawQuery) == 0 || len(c.params) == 0 {
+		return nil, nil
+	}
+	hostname := u.Hostname()
+	var kept, removed []string
+	for _, part := range strings.Split(u.RawQuery, "&") {
+		name := part
+		if i := strings.Index(part, "="); i >= 0 {
+			name = part[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if len(name) > 0 && c.removes(hostname, name) {
+			removed = append(removed, name)
+		} else {
+			kept = append(kept, part)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	cleaned := *u
+	cleaned.RawQuery = strings.Join(kept, "&")
+	cleaned.ForceQuery = false
+	return &cleaned, removed
+}
+
+// Clean the url of a request going thru the proxy.  Urls let thru with the
+// exception string are left exactly as the user asked for them.  A nil Cleaner
+// (cleaning turned off) cleans nothing.
+func (c *Cleaner) CleanProxied(u *url.URL) (*url.URL, []string) {
+	if c == nil || strings.HasSuffix(u.String(), vars.ProxyExceptionString) {
+		return nil, nil
+	}
+	return c.Clean(u)
+}
+
+// Whether the parameter called name comes off urls on hostname
+func (c *Cleaner) removes(hostname, name string) bool {
+	if !matchesParam(c.params, name) {
+		return false
+	}
+	for _, e := range c.exceptions {
+		if e.hosts.Matches(hostname) && (len(e.params) == 0 || matchesParam(e.params, name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesParam(params []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range params {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(name, p[:len(p)-1]) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Lowercase the parameter names, making sure * only shows up at the end
+func parseParams(params []string) ([]string, error) {
+	parsed := make([]string, 0, len(params))
+	for _, p := range params {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if len(p) == 0 || p == "*" || strings.Contains(strings.TrimSuffix(p, "*"), "*") {
+			return nil, fmt.Errorf("invalid parameter %q, expected a name or a prefix followed by *", p)
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,88 @@
+package urlclean
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/jcuga/proxyblock/proxy/config"
+	"github.com/jcuga/proxyblock/proxy/vars"
+)
+
+func TestClean(t *testing.T) {
+	c, err := NewCleaner(config.TrackingConfig{
+		Params: []string{"utm_*", "FBCLID", "gclid"},
+		Exceptions: []config.TrackingException{
+			{Hosts: []string{"shop.example.com"}, Params: []string{"gclid"}},
+			{Hosts: []string{".analytics.example.org"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url         string
+		want        string
+		wantRemoved []string
+	}{
+		{"https://example.com/a?utm_source=x&id=1&utm_medium=y", "https://example.com/a?id=1", []string{"utm_source", "utm_medium"}},
+		{"https://example.com/a?fbclid=1", "https://example.com/a", []string{"fbclid"}},
+		{"https://example.com/a?UTM_Source=x&b=%20c&c", "https://example.com/a?b=%20c&c", []string{"UTM_Source"}},
+		{"https://example.com/a?utm%5Fsource=x#frag", "https://example.com/a#frag", []string{"utm_source"}},
+		// only gclid stays on the shop
+		{"https://shop.example.com/?gclid=1&utm_source=x", "https://shop.example.com/?gclid=1", []string{"utm_source"}},
+		// every parameter stays on the analytics hosts
+		{"https://www.analytics.example.org/?utm_source=x", "", nil},
+		{"https://example.com/a?id=1&utm=2", "", nil},
+		{"https://example.com/a", "", nil},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleaned, removed := c.Clean(u)
+		var got string
+		if cleaned != nil {
+			got = cleaned.String()
+		}
+		if got != test.want || !reflect.DeepEqual(removed, test.wantRemoved) {
+			t.Errorf("Clean(%s) = %q %v, want %q %v", test.url, got, removed, test.want, test.wantRemoved)
+		}
+		if u.String() != test.url {
+			t.Errorf("Clean(%s) changed the url it was given to %s", test.url, u)
+		}
+	}
+}
+
+func TestCleanProxied(t *testing.T) {
+	u, _ := url.Parse("http://example.com/?utm_source=x&" + vars.ProxyExceptionString)
+	c, err := NewCleaner(config.TrackingConfig{Params: []string{"utm_*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cleaned, _ := c.CleanProxied(u); cleaned != nil {
+		t.Errorf("url with the exception string cleaned to %s", cleaned)
+	}
+	u, _ = url.Parse("http://example.com/?utm_source=x")
+	if cleaned, _ := c.CleanProxied(u); cleaned == nil || cleaned.String() != "http://example.com/" {
+		t.Errorf("CleanProxied(%s) = %v", u, cleaned)
+	}
+	var off *Cleaner
+	if cleaned, _ := off.CleanProxied(u); cleaned != nil {
+		t.Errorf("nil Cleaner cleaned %s to %s", u, cleaned)
+	}
+}
+
+func TestNewCleanerRejectsBadParams(t *testing.T) {
+	for _, params := range [][]string{{"*"}, {""}, {"utm_*x"}, {"*utm"}} {
+		if _, err := NewCleaner(config.TrackingConfig{Params: params}); err == nil {
+			t.Errorf("NewCleaner(%q) didn't fail", params)
+		}
+	}
+	_, err := NewCleaner(config.TrackingConfig{Params: []string{"utm_*"},
+		Exceptions: []config.TrackingException{{Hosts: []string{"example.com"}, Params: []string{"*"}}}})
+	if err == nil {
+		t.Errorf("NewCleaner with a bad exception didn't fail")
+	}
+}
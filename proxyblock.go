@@ -1,19 +1,173 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 
 	"github.com/jcuga/proxyblock/proxy"
+	"github.com/jcuga/proxyblock/proxy/config"
+	"github.com/jcuga/proxyblock/proxy/history"
+	"github.com/jcuga/proxyblock/proxy/rules"
+	"github.com/jcuga/proxyblock/proxy/stats"
+	"github.com/jcuga/proxyblock/proxy/urlclean"
+	"github.com/jcuga/proxyblock/proxy/vars"
 	"github.com/jcuga/proxyblock/utils"
 )
 
+const usage = `usage: proxyblock <command> [flags]
+
+commands:
+    serve               run the proxy (default when no command is given)
+    check <url>         show whether a url would be allowed or blocked and by which rule
+    lint                validate the whitelist/blacklist files
+    stats               show stats from a running proxy
+    report              replay a request history file and report unused/shadowed/duplicate rules
+
+Run 'proxyblock <command> -h' for a command's flags.
+`
+
 func main() {
-	verbose := flag.Bool("v", false, "should every proxy request be logged to stdout")
-	addr := flag.String("addr", "127.0.0.1:3128", "proxy listen address")
-	whitelistFilename := flag.String("wl", "whitelist.txt", "file of regexes to whitelist request urls (overrides blacklist)")
-	blacklistFilename := flag.String("bl", "blacklist.txt", "file of regexes to blacklistlist request urls")
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+	switch command {
+	case "serve":
+		serve(args)
+	case "check":
+		check(args)
+	case "lint":
+		lint(args)
+	case "stats":
+		printStats(args)
+	case "report":
+		report(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+// Flags shared by all commands that need the proxy configuration.  Flags that
+// are explicitly given override the values from the config file.
+type configFlags struct {
+	fs                *flag.FlagSet
+	configFilename    *string
+	whitelistFilename *string
+	blacklistFilename *string
+	// only registered by some commands:
+	verbose         *bool
+	addr            *string
+	socksAddr       *string
+	dnsAddr         *string
+	historyFilename *string
+	historySize     *int
+}
+
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	defaults := config.Default()
+	return &configFlags{
+		fs:                fs,
+		configFilename:    fs.String("config", "", "JSON config file (see proxyblock.example.json), flags override its values"),
+		whitelistFilename: fs.String("wl", defaults.Rules.Whitelists[0], "file of regexes to whitelist request urls (overrides blacklist)"),
+		blacklistFilename: fs.String("bl", defaults.Rules.Blacklists[0], "file of regexes to blacklistlist request urls"),
+	}
+}
+
+func (f *configFlags) addServeFlags() {
+	defaults := config.Default()
+	f.verbose = f.fs.Bool("v", defaults.Logging.Verbose, "should every proxy request be logged to stdout")
+	f.addr = f.fs.String("addr", defaults.ListenAddr, "proxy listen address")
+	f.socksAddr = f.fs.String("socks-addr", defaults.Socks.ListenAddr, "SOCKS5 listen address (optional)")
+	f.dnsAddr = f.fs.String("dns-addr", defaults.Dns.ListenAddr, "DNS sinkhole listen address, UDP and TCP (optional)")
+	f.addHistoryFlag("file to record request history in (optional, history is kept in memory regardless)")
+	f.historySize = f.fs.Int("history-size", defaults.Storage.HistorySize, "max number of recent requests to keep in memory")
+}
+
+func (f *configFlags) addHistoryFlag(usage string) {
+	f.historyFilename = f.fs.String("history", config.Default().Storage.HistoryFile, usage)
+}
+
+// Load the config file (if any) and apply flag overrides.  Must be called
+// after the flags are parsed.
+func (f *configFlags) load() *config.Config {
+	conf := config.Default()
+	if len(*f.configFilename) > 0 {
+		var err error
+		if conf, err = config.Load(*f.configFilename); err != nil {
+			log.Fatalf("Could not load config. Error: %s", err)
+		}
+	}
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "wl":
+			conf.Rules.Whitelists = []string{*f.whitelistFilename}
+		case "bl":
+			conf.Rules.Blacklists = []string{*f.blacklistFilename}
+		case "v":
+			conf.Logging.Verbose = *f.verbose
+		case "addr":
+			conf.ListenAddr = *f.addr
+		case "socks-addr":
+			conf.Socks.ListenAddr = *f.socksAddr
+		case "dns-addr":
+			conf.Dns.ListenAddr = *f.dnsAddr
+		case "history":
+			conf.Storage.HistoryFile = *f.historyFilename
+		case "history-size":
+			conf.Storage.HistorySize = *f.historySize
+		}
+	})
+	if err := conf.Validate(); err != nil {
+		log.Fatalf("Invalid config. Error: %s", err)
+	}
+	vars.ProxyControlPort = conf.ControlPort
+	vars.ProxyExceptionString = conf.ExceptionString
+	return conf
+}
+
+func loadRules(conf *config.Config) *rules.Lists {
+	whiteList, wlErr := rules.LoadFiles(conf.Rules.Whitelists)
+	if wlErr != nil {
+		log.Fatalf("Could not load whitelist. Error: %s", wlErr)
+	}
+	blackList, blErr := rules.LoadFiles(conf.Rules.Blacklists)
+	if blErr != nil {
+		log.Fatalf("Could not load blacklist. Error: %s", blErr)
+	}
+	return &rules.Lists{WhiteList: whiteList, BlackList: blackList, Order: conf.Rules.Order}
+}
+
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	confFlags := addConfigFlags(fs)
+	confFlags.addServeFlags()
+	printConfig := fs.Bool("print-config", false, "print the effective config (file plus flags) and exit")
+	fs.Parse(args)
+	conf := confFlags.load()
+	if *printConfig {
+		if err := conf.Write(os.Stdout); err != nil {
+			log.Fatalf("Could not print config. Error: %s", err)
+		}
+		return
+	}
+	if len(conf.Logging.File) > 0 {
+		logFile, err := os.OpenFile(conf.Logging.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("Could not open log file. Error: %s", err)
+		}
+		log.SetOutput(logFile)
+	}
 
 	// Additional whitelist/blacklist entries are added by the user, these
 	// are sent thru channels so the proxy can update itself.
@@ -23,23 +177,161 @@ func main() {
 	whiteListUpdates := make(chan string, 200)
 	blackListUpdates := make(chan string, 200)
 
-	flag.Parse()
-	whiteList, wlErr := utils.GetRegexlist(*whitelistFilename)
-	if wlErr != nil {
-		log.Fatalf("Could not load whitelist. Error: %s", wlErr)
-	}
-	blackList, blErr := utils.GetRegexlist(*blacklistFilename)
-	if blErr != nil {
-		log.Fatalf("Could not load blacklist. Error: %s", blErr)
+	lists := loadRules(conf)
+
+	requestHistory := history.New(conf.Storage.HistorySize)
+	if len(conf.Storage.HistoryFile) > 0 {
+		var histErr error
+		requestHistory, histErr = history.Open(conf.Storage.HistoryFile, conf.Storage.HistorySize)
+		if histErr != nil {
+			log.Fatalf("Could not open history. Error: %s", histErr)
+		}
 	}
 
-	proxy, err := proxy.CreateProxy(whiteList, blackList, *verbose,
-		whiteListUpdates, blackListUpdates)
+	proxy, err := proxy.CreateProxy(conf, lists, whiteListUpdates, blackListUpdates, requestHistory)
 	if err != nil {
 		log.Fatalf("Error creating proxy: %s", err)
 	} else {
-		log.Printf("Starting proxy on: %s", *addr)
+		log.Printf("Starting proxy on: %s", conf.ListenAddr)
 		// Start proxy (this call is blocking)
-		log.Fatal(http.ListenAndServe(*addr, proxy))
+		log.Fatal(http.ListenAndServe(conf.ListenAddr, proxy))
+	}
+}
+
+func check(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	confFlags := addConfigFlags(fs)
+	referer := fs.String("referer", "", "page the request is made from")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: proxyblock check [flags] <url>\n")
+		fs.PrintDefaults()
+	}
+	// allow flags both before and after the url
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	urlString := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+
+	conf := confFlags.load()
+	lists := loadRules(conf)
+	u, err := url.Parse(strings.TrimSpace(urlString))
+	if err != nil {
+		log.Fatalf("Invalid url. Error: %s", err)
+	}
+	// Same as the proxy: tracking parameters come off first, and https urls
+	// are matched as http
+	var cleaner *urlclean.Cleaner
+	if conf.Tracking.Enabled {
+		if cleaner, err = urlclean.NewCleaner(conf.Tracking); err != nil {
+			log.Fatalf("Invalid config. Error: %s", err)
+		}
+	}
+	cleaned, removed := cleaner.CleanProxied(u)
+	if cleaned != nil {
+		u = cleaned
+	}
+	if u.Scheme == "https" {
+		u.Scheme = "http"
+	}
+	decision := lists.Decide(u.String())
+	fmt.Println(decision.Action)
+	if decision.Rule != nil {
+		fmt.Printf("  rule:   %s  %s\n", decision.Rule.Location(), decision.Rule.Pattern)
+	} else {
+		fmt.Printf("  reason: %s\n", decision.Reason)
+	}
+	fmt.Printf("  url:    %s\n", u)
+	if len(removed) > 0 {
+		fmt.Printf("  cleaned: removed %s\n", strings.Join(removed, ", "))
+	}
+	// The page whose controls (and history) the request shows up under
+	if len(*referer) > 0 {
+		fmt.Printf("  page:   %s\n", utils.StripProxyExceptionStringFromUrl(*referer))
+	}
+}
+
+func lint(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	confFlags := addConfigFlags(fs)
+	fs.Parse(args)
+
+	conf := confFlags.load()
+	problems, err := rules.Lint(append(conf.Rules.Whitelists, conf.Rules.Blacklists...)...)
+	if err != nil {
+		log.Fatalf("Could not lint rules. Error: %s", err)
+	}
+	numErrors := 0
+	for _, p := range problems {
+		fmt.Println(p.String())
+		if !p.Warning {
+			numErrors++
+		}
+	}
+	fmt.Printf("%d errors, %d warnings\n", numErrors, len(problems)-numErrors)
+	if numErrors > 0 {
+		os.Exit(1)
+	}
+}
+
+func printStats(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	confFlags := addConfigFlags(fs)
+	controlAddr := fs.String("control", "", "control server address of the running proxy (default 127.0.0.1:<control_port from config>)")
+	asJson := fs.Bool("json", false, "print the raw json")
+	fs.Parse(args)
+	conf := confFlags.load()
+	if len(*controlAddr) == 0 {
+		*controlAddr = "127.0.0.1:" + conf.ControlPort
+	}
+
+	resp, err := http.Get("http://" + *controlAddr + stats.StatsUrl)
+	if err != nil {
+		log.Fatalf("Could not query proxy. Error: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Could not query proxy. Status: %s", resp.Status)
+	}
+	var snap stats.Snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snap); err != nil {
+		log.Fatalf("Could not parse stats. Error: %s", err)
+	}
+	if *asJson {
+		out, _ := json.MarshalIndent(snap, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	fmt.Printf("Running since %s (%ds)\n\nRequests:\n", snap.Started.Format("2006-01-02 15:04:05"), snap.UptimeSeconds)
+	for _, action := range []string{rules.Allowed, rules.ManuallyAllowed, rules.Blocked, rules.NotMatched} {
+		fmt.Printf("  %-30s %d\n", action, snap.Requests[action])
+	}
+	fmt.Printf("\nRule hits:\n")
+	for _, h := range snap.RuleHits {
+		fmt.Printf("  %6d  %s  %s\n", h.Hits, h.Rule, h.Pattern)
+	}
+	fmt.Printf("\nPage controls injected: %d, not injected: %d\n", snap.Injected, snap.NotInjected)
+	for _, f := range snap.InjectionFailures {
+		fmt.Printf("  %s  %s  %s\n", f.Time.Format("2006-01-02 15:04:05"), f.Reason, f.Url)
+	}
+}
+
+func report(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	confFlags := addConfigFlags(fs)
+	confFlags.addHistoryFlag("request history file written by 'serve -history' (overrides storage.history_file)")
+	fs.Parse(args)
+
+	conf := confFlags.load()
+	if len(conf.Storage.HistoryFile) == 0 {
+		log.Fatalf("No history file to replay, use -history or set storage.history_file in the config.")
+	}
+	lists := loadRules(conf)
+	entries, err := history.ReadFile(conf.Storage.HistoryFile)
+	if err != nil {
+		log.Fatalf("Could not read history. Error: %s", err)
 	}
+	rules.Analyze(lists, history.Urls(entries)).WriteText(os.Stdout)
 }
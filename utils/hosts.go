@@ -0,0 +1,87 @@
+package utils
+
+// NO_PROXY style host lists.  Entries can be:
+//   *                 every host
+//   example.com       example.com and all of its subdomains
+//   .example.com      only subdomains of example.com
+//   10.0.0.0/8        any ip in the range
+//   192.168.1.1       that ip
+
+import (
+	"net"
+	"strings"
+)
+
+type HostList struct {
+	all      bool
+	domains  []string
+	suffixes []string
+	nets     []*net.IPNet
+	ips      []net.IP
+}
+
+func ParseHostList(entries []string) HostList {
+	var l HostList
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch {
+		case len(e) == 0:
+			continue
+		case e == "*":
+			l.all = true
+		case strings.Contains(e, "/"):
+			if _, n, err := net.ParseCIDR(e); err == nil {
+				l.nets = append(l.nets, n)
+			}
+		case net.ParseIP(StripPort(e)) != nil:
+			l.ips = append(l.ips, net.ParseIP(StripPort(e)))
+		case strings.HasPrefix(e, "*."):
+			l.suffixes = append(l.suffixes, e[1:])
+		case strings.HasPrefix(e, "."):
+			l.suffixes = append(l.suffixes, e)
+		default:
+			l.domains = append(l.domains, StripPort(e))
+		}
+	}
+	return l
+}
+
+// Whether hostname (no port) is in the list
+func (l HostList) Matches(hostname string) bool {
+	if l.all {
+		return true
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if ip := net.ParseIP(hostname); ip != nil {
+		for _, n := range l.nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		for _, listIp := range l.ips {
+			if listIp.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, d := range l.domains {
+		if hostname == d || strings.HasSuffix(hostname, "."+d) {
+			return true
+		}
+	}
+	for _, s := range l.suffixes {
+		if strings.HasSuffix(hostname, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Host without the port (and without brackets for ipv6)
+func StripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
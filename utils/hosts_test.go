@@ -0,0 +1,53 @@
+package utils
+
+import "testing"
+
+func TestHostList(t *testing.T) {
+	// as in mitm.no_mitm_hosts
+	l := ParseHostList([]string{"Bank.example.com", ".apps.example.org", "*.pinned.net", "10.0.0.0/8", "192.168.1.1", "[::1]:443", " ", "bad/cidr"})
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"bank.example.com", true},
+		{"www.BANK.example.com", true},
+		{"bank.example.com.", true},
+		{"notbank.example.com", false},
+		{"example.com", false},
+		{"apps.example.org", false},
+		{"mail.apps.example.org", true},
+		{"pinned.net", false},
+		{"api.pinned.net", true},
+		{"10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"::1", true},
+		{"other.com", false},
+	}
+	for _, test := range tests {
+		if got := l.Matches(test.host); got != test.want {
+			t.Errorf("Matches(%q) = %v, want %v", test.host, got, test.want)
+		}
+	}
+	if !ParseHostList([]string{"*"}).Matches("anything.com") {
+		t.Errorf("* didn't match everything")
+	}
+	if ParseHostList(nil).Matches("example.com") {
+		t.Errorf("empty list matched")
+	}
+}
+
+func TestStripPort(t *testing.T) {
+	for host, want := range map[string]string{
+		"example.com:443": "example.com",
+		"example.com":     "example.com",
+		"[::1]:8080":      "::1",
+		"[::1]":           "::1",
+		"10.0.0.1:53":     "10.0.0.1",
+	} {
+		if got := StripPort(host); got != want {
+			t.Errorf("StripPort(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
@@ -3,43 +3,14 @@ package utils
 // Common utility functions
 
 import (
-	"bufio"
-	"log"
-	"os"
-	"regexp"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/jcuga/proxyblock/proxy/vars"
 )
 
-// Parse a file of regular expressions, ignoring comments/whitespace
-func GetRegexlist(filename string) ([]*regexp.Regexp, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Fatalf("Error opening %s: %q", filename, err)
-	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	var list []*regexp.Regexp = make([]*regexp.Regexp, 0)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		// ignore blank/whitespace lines and comments
-		if len(line) > 0 && !strings.HasPrefix(line, "#") {
-			// add ignore case option to regex and compile it
-			if r, err := regexp.Compile("(?i)" + line); err == nil {
-				list = append(list, r)
-			} else {
-				log.Fatalf("Invalid pattern: %q", err)
-			}
-		}
-	}
-	if err := scanner.Err(); err != nil {
-		log.Fatalf("Error reading %s: %q", filename, err)
-	}
-	return list, nil
-}
-
 // Since our event subscriptions (longpoll) are based on a 'category' which is
 // the URL/referer, when we add a proxy exception string to manually bypass
 // content blocking, the string on the end of the URL will cause a mismatch and
@@ -57,3 +28,19 @@ func StripProxyExceptionStringFromUrl(url string) string {
 func TimeToEpochMilliseconds(t time.Time) int64 {
 	return t.UnixNano() / int64(time.Millisecond)
 }
+
+// Whether r came from one of our own control pages.  Keeps other sites from
+// changing settings by posting forms to the control server.  Requests with
+// neither Origin nor Referer weren't sent by a browser page and are allowed.
+func IsSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		referer, err := url.Parse(r.Header.Get("Referer"))
+		if err != nil || len(referer.Host) == 0 {
+			// neither header, not sent by a browser
+			return len(r.Header.Get("Referer")) == 0
+		}
+		origin = referer.Scheme + "://" + referer.Host
+	}
+	return origin == "http://127.0.0.1:"+vars.ProxyControlPort
+}